@@ -0,0 +1,57 @@
+package webservice
+
+import (
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+// The context key under which authentication middleware stores the
+// authenticated principal. Custom authentication middleware should set it
+// with Context.SetValue so that handlers can use Context.RemoteUser.
+var RemoteUserKey = contextKey("remote user")
+
+// The principal authenticated for this request, if any.
+func (c *Context) RemoteUser() (interface{}, bool) {
+	user := c.Context().Value(RemoteUserKey)
+	return user, user != nil
+}
+
+// Require HTTP basic authentication. authenticate returns the principal for
+// valid credentials, which is then available from Context.RemoteUser.
+// Requests without valid credentials receive 401 Unauthorized.
+func (r *Route) BasicAuth(realm string, authenticate func(username, password string) (interface{}, bool)) *Route {
+	r.middleware = append(r.middleware, func(cx *Context, next func() bool) bool {
+		if username, password, ok := cx.Request.BasicAuth(); ok {
+			if user, ok := authenticate(username, password); ok && user != nil {
+				cx.SetValue(RemoteUserKey, user)
+				return next()
+			}
+		}
+		cx.ResponseWriter.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		cx.RespondWithStatus(http.StatusUnauthorized)
+		return true
+	})
+	return r
+}
+
+// Require an "Authorization: Bearer <token>" header. authenticate returns
+// the principal for a valid token, which is then available from
+// Context.RemoteUser. Requests without a valid token receive 401
+// Unauthorized.
+func (r *Route) BearerAuth(authenticate func(token string) (interface{}, bool)) *Route {
+	r.middleware = append(r.middleware, func(cx *Context, next func() bool) bool {
+		header := cx.Request.Header.Get("Authorization")
+		if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+			if user, ok := authenticate(strings.TrimSpace(header[7:])); ok && user != nil {
+				cx.SetValue(RemoteUserKey, user)
+				return next()
+			}
+		}
+		cx.ResponseWriter.Header().Set("WWW-Authenticate", "Bearer")
+		cx.RespondWithStatus(http.StatusUnauthorized)
+		return true
+	})
+	return r
+}
@@ -0,0 +1,69 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteUser(t *testing.T) {
+	s := NewService("/")
+	whoami := func(cx *Context) {
+		user, ok := cx.RemoteUser()
+		if !ok {
+			cx.RespondWithStatus(http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(user.(*testUser).Name)
+	}
+	s.Get().Path("basic").BasicAuth("test", func(username, password string) (interface{}, bool) {
+		return &testUser{Name: username}, password == "secret"
+	}).ToFunction(whoami)
+	s.Get().Path("bearer").BearerAuth(func(token string) (interface{}, bool) {
+		return &testUser{Name: "bob"}, token == "token"
+	}).ToFunction(whoami)
+	s.Get().Path("anonymous").ToFunction(func(cx *Context) {
+		_, ok := cx.RemoteUser()
+		cx.RespondWithData(ok)
+	})
+
+	req := newTestRequest("GET", "/basic", nil, "application/json")
+	req.SetBasicAuth("alice", "secret")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, "alice")
+
+	req = newTestRequest("GET", "/bearer", nil, "application/json")
+	req.Header.Set("Authorization", "Bearer token")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, "bob")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/anonymous", nil, "application/json"))
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, false)
+}
+
+func TestAuthRejected(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("basic").BasicAuth("test", func(username, password string) (interface{}, bool) {
+		return username, password == "secret"
+	}).ToFunction(func(cx *Context) {})
+	s.Get().Path("bearer").BearerAuth(func(token string) (interface{}, bool) {
+		return token, token == "token"
+	}).ToFunction(func(cx *Context) {})
+
+	req := newTestRequest("GET", "/basic", nil, "application/json")
+	req.SetBasicAuth("alice", "wrong")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusUnauthorized)
+	assert.Equal(t, writer.Header().Get("WWW-Authenticate"), `Basic realm="test"`)
+
+	req = newTestRequest("GET", "/bearer", nil, "application/json")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusUnauthorized)
+	assert.Equal(t, writer.Header().Get("WWW-Authenticate"), "Bearer")
+}
@@ -0,0 +1,317 @@
+package webservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Populate the fields of the struct pointed to by v from values. Fields are
+// matched by their tag (eg. `query:"page"`) or, failing that, by name
+// ignoring case. Slice fields receive every value for their key. Struct
+// fields are bound from dotted keys (eg. address.city), and slices of structs
+// from indexed keys (eg. items[0].name). Fields of untagged embedded structs
+// are bound as if they were promoted. A slice field tagged with the comma
+// option (eg. `query:"ids,comma"`) also splits a single value at commas.
+// Invalid values are reported as a *DecodeError.
+func bindValues(values url.Values, v interface{}, tag string) error {
+	return bindFields(values, v, tag, true)
+}
+
+// Bind values into v as with bindValues. If untagged is false, only fields
+// with the tag (or within fields with the tag) are bound.
+func bindFields(values url.Values, v interface{}, tag string, untagged bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("can only bind to a pointer to a struct")
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	decodeErr := &DecodeError{}
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		key, options := parseTag(field.Tag.Get(tag))
+		if key == "-" {
+			continue
+		}
+		if embedded, ok := embeddedStruct(rv.Field(i), field); ok && key == "" {
+			if err := bindFields(values, embedded, tag, untagged); err != nil {
+				decodeErr.merge("", err)
+			}
+			continue
+		}
+		if key == "" && !untagged {
+			continue
+		}
+		name := key
+		if name == "" {
+			name = field.Name
+		}
+		if nested, err := bindNested(values, rv.Field(i), name, key == "", tag); nested {
+			if err != nil {
+				decodeErr.Fields = append(decodeErr.Fields, err.(*DecodeError).Fields...)
+			}
+			continue
+		}
+		var strs []string
+		if key != "" {
+			strs = values[key]
+		} else {
+			strs = lookupFold(values, field.Name)
+		}
+		if len(strs) == 0 {
+			continue
+		}
+		if options["comma"] && field.Type.Kind() == reflect.Slice && len(strs) == 1 {
+			strs = strings.Split(strs[0], ",")
+		}
+		if key == "" {
+			key = field.Name
+		}
+		if err := setField(rv.Field(i), strs); err != nil {
+			decodeErr.Add(key, err.Error())
+		}
+	}
+	if len(decodeErr.Fields) != 0 {
+		return decodeErr
+	}
+	return nil
+}
+
+// Populate v, a pointer to a struct, from the request's query parameters.
+// Fields are matched by their `query:"..."` tag or by name, as with
+// bindValues. Invalid values are reported as a *DecodeError.
+func (c *Context) BindQuery(v interface{}) error {
+	return bindValues(c.Request.URL.Query(), v, "query")
+}
+
+// Populate the fields of the struct pointed to by v that are tagged with a
+// header name (eg. `header:"X-Request-Id"`) from header. Slice fields receive
+// every value of a repeated header. Untagged fields and other values of v
+// are left untouched. Invalid values are reported as a *DecodeError.
+func bindHeaders(header http.Header, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	decodeErr := &DecodeError{}
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		key := field.Tag.Get("header")
+		if embedded, ok := embeddedStruct(rv.Field(i), field); ok && key == "" {
+			if err := bindHeaders(header, embedded); err != nil {
+				decodeErr.merge("", err)
+			}
+			continue
+		}
+		if field.PkgPath != "" || key == "" || key == "-" {
+			continue
+		}
+		strs := header.Values(key)
+		if len(strs) == 0 {
+			continue
+		}
+		if err := setField(rv.Field(i), strs); err != nil {
+			decodeErr.Add(key, err.Error())
+		}
+	}
+	if len(decodeErr.Fields) != 0 {
+		return decodeErr
+	}
+	return nil
+}
+
+// Populate v, a pointer to a struct, from the whole request: the body if
+// there is one, then query parameters (`query:"..."` tags), path parameters
+// (`path:"..."` tags) and headers (`header:"..."` tags). Later sources
+// override earlier ones. Unlike BindQuery, only tagged fields are bound from
+// the query and path, so clients can not override body fields through the
+// URL.
+func (c *Context) Bind(v interface{}) error {
+	if c.Request.Body != nil && c.Request.Body != http.NoBody && c.Request.ContentLength != 0 {
+		if err := c.Receive(v); err != nil {
+			return asDecodeError(err)
+		}
+	}
+	if err := bindFields(c.Request.URL.Query(), v, "query", false); err != nil {
+		return err
+	}
+	params := url.Values{}
+	if c.route != nil {
+		for i, param := range c.route.params {
+			if i < len(c.Args) {
+				params.Set(param, c.Args[i])
+			}
+		}
+	}
+	if err := bindFields(params, v, "path", false); err != nil {
+		return err
+	}
+	return bindHeaders(c.Request.Header, v)
+}
+
+// Bind the request into v, as with Bind. On failure, responds with 400 Bad
+// Request, including any field details, or 413 Request Entity Too Large if
+// the body exceeds the route's limit, and returns false.
+func (c *Context) MustBind(v interface{}) bool {
+	if err := c.Bind(v); err != nil {
+		c.RespondWithError(decodeErrorStatus(err), err)
+		return false
+	}
+	return true
+}
+
+// Bind nested keys (name.field) into a struct field, or indexed keys
+// (name[0].field) into a slice of structs. Returns false if field is not a
+// struct or slice of structs, or if a coercion is registered for the struct,
+// in which case it is bound from a single value.
+func bindNested(values url.Values, field reflect.Value, name string, fold bool, tag string) (bool, error) {
+	decodeErr := &DecodeError{}
+	switch {
+	case hasCoercion(field.Type()) || field.Kind() == reflect.Slice && hasCoercion(field.Type().Elem()):
+		return false, nil
+
+	case field.Kind() == reflect.Struct:
+		nested := url.Values{}
+		for key, strs := range values {
+			head, rest := splitNestedKey(key)
+			if matchKey(head, name, fold) && strings.HasPrefix(rest, ".") {
+				nested[rest[1:]] = strs
+			}
+		}
+		if len(nested) != 0 {
+			if err := bindValues(nested, field.Addr().Interface(), tag); err != nil {
+				decodeErr.merge(name+".", err)
+			}
+		}
+
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+		indexed := map[int]url.Values{}
+		for key, strs := range values {
+			head, rest := splitNestedKey(key)
+			if !matchKey(head, name, fold) || !strings.HasPrefix(rest, "[") {
+				continue
+			}
+			end := strings.Index(rest, "].")
+			if end < 0 {
+				continue
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				decodeErr.Add(key, "invalid index")
+				continue
+			}
+			if indexed[index] == nil {
+				indexed[index] = url.Values{}
+			}
+			indexed[index][rest[end+2:]] = strs
+		}
+		indexes := make([]int, 0, len(indexed))
+		for index := range indexed {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		slice := reflect.MakeSlice(field.Type(), 0, len(indexes))
+		for _, index := range indexes {
+			elem := reflect.New(field.Type().Elem())
+			if err := bindValues(indexed[index], elem.Interface(), tag); err != nil {
+				decodeErr.merge(fmt.Sprintf("%s[%d].", name, index), err)
+			}
+			slice = reflect.Append(slice, elem.Elem())
+		}
+		if len(indexes) != 0 {
+			field.Set(slice)
+		}
+
+	default:
+		return false, nil
+	}
+	if len(decodeErr.Fields) != 0 {
+		return true, decodeErr
+	}
+	return true, nil
+}
+
+// A pointer to the exported embedded struct in value, described by field,
+// allocating it if it is a nil pointer.
+func embeddedStruct(value reflect.Value, field reflect.StructField) (interface{}, bool) {
+	if !field.Anonymous || field.PkgPath != "" {
+		return nil, false
+	}
+	switch {
+	case value.Kind() == reflect.Struct:
+		return value.Addr().Interface(), true
+	case value.Kind() == reflect.Ptr && value.Type().Elem().Kind() == reflect.Struct:
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		return value.Interface(), true
+	}
+	return nil, false
+}
+
+// Split a struct tag value into its key and comma separated options.
+func parseTag(value string) (string, map[string]bool) {
+	parts := strings.Split(value, ",")
+	options := map[string]bool{}
+	for _, option := range parts[1:] {
+		options[option] = true
+	}
+	return parts[0], options
+}
+
+// Split a key at its first "." or "[".
+func splitNestedKey(key string) (string, string) {
+	if i := strings.IndexAny(key, ".["); i >= 0 {
+		return key[:i], key[i:]
+	}
+	return key, ""
+}
+
+func matchKey(key, name string, fold bool) bool {
+	return key == name || (fold && strings.EqualFold(key, name))
+}
+
+func lookupFold(values url.Values, name string) []string {
+	if strs, ok := values[name]; ok {
+		return strs
+	}
+	for key, strs := range values {
+		if strings.EqualFold(key, name) {
+			return strs
+		}
+	}
+	return nil
+}
+
+// Coerce strs into field. Slices receive every value, other kinds the first.
+func setField(field reflect.Value, strs []string) error {
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), 0, len(strs))
+		for _, s := range strs {
+			v, err := coerce(s, field.Type().Elem())
+			if err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, v.Convert(field.Type().Elem()))
+		}
+		field.Set(slice)
+		return nil
+	}
+	v, err := coerce(strs[0], field.Type())
+	if err != nil {
+		return err
+	}
+	field.Set(v.Convert(field.Type()))
+	return nil
+}
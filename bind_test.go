@@ -0,0 +1,194 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type queryParams struct {
+	IDs   []int    `query:"id"`
+	Tags  []string `query:"tag"`
+	Limit int
+}
+
+func TestBindValuesSlices(t *testing.T) {
+	values, err := url.ParseQuery("id=1&id=2&id=3&tag=a&tag=b&limit=10")
+	assert.NoError(t, err)
+	params := &queryParams{}
+	assert.NoError(t, bindValues(values, params, "query"))
+	assert.Equal(t, params.IDs, []int{1, 2, 3})
+	assert.Equal(t, params.Tags, []string{"a", "b"})
+	assert.Equal(t, params.Limit, 10)
+}
+
+func TestBindValuesSliceCoercionError(t *testing.T) {
+	values, err := url.ParseQuery("id=1&id=two")
+	assert.NoError(t, err)
+	assert.Error(t, bindValues(values, &queryParams{}, "query"))
+}
+
+type pagination struct {
+	Page    int `query:"page"`
+	PerPage int `query:"per_page"`
+	Sort    string
+}
+
+func TestBindQuery(t *testing.T) {
+	var params pagination
+	var bindErr error
+	s := NewService("/")
+	s.Get().Path("things").ToFunction(func(cx *Context) {
+		params = pagination{}
+		bindErr = cx.BindQuery(&params)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", "/things?page=2&per_page=50&sort=name", nil, "application/json"))
+	assert.NoError(t, bindErr)
+	assert.Equal(t, params, pagination{Page: 2, PerPage: 50, Sort: "name"})
+
+	s.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", "/things?page=two", nil, "application/json"))
+	assert.Error(t, bindErr)
+	assert.Equal(t, bindErr.(*DecodeError).Fields[0].Field, "page")
+}
+
+type createOrder struct {
+	Item           string
+	IdempotencyKey string   `header:"X-Idempotency-Key"`
+	APIVersion     int      `header:"X-Api-Version"`
+	Tags           []string `header:"X-Tag"`
+}
+
+func TestBindHeaders(t *testing.T) {
+	var order *createOrder
+	s := NewService("/")
+	s.Post().Path("orders").DecodeRequest(&createOrder{}).ToFunction(func(cx *Context, req *createOrder) {
+		order = req
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	req := newTestRequest("POST", "/orders", strings.NewReader(`{"Item": "widget"}`), "application/json")
+	req.Header.Set("X-Idempotency-Key", "abc123")
+	req.Header.Set("X-API-Version", "2")
+	req.Header.Add("X-Tag", "a")
+	req.Header.Add("X-Tag", "b")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, order, &createOrder{Item: "widget", IdempotencyKey: "abc123", APIVersion: 2, Tags: []string{"a", "b"}})
+
+	req = newTestRequest("POST", "/orders", strings.NewReader(`{}`), "application/json")
+	req.Header.Set("X-API-Version", "two")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+}
+
+type BaseRequest struct {
+	RequestID string `header:"X-Request-Id" form:"request_id"`
+	Locale    string
+}
+
+type embeddingRequest struct {
+	BaseRequest
+	Name string `form:"name"`
+}
+
+func TestBindEmbeddedStructs(t *testing.T) {
+	var decoded *embeddingRequest
+	s := NewService("/")
+	s.Post().Path("things").DecodeRequest(&embeddingRequest{}).ToFunction(func(cx *Context, req *embeddingRequest) {
+		decoded = req
+		cx.RespondWithStatus(http.StatusOK)
+	})
+
+	req := newTestRequest("POST", "/things", strings.NewReader(`{"Locale": "en", "Name": "thing"}`), "application/json")
+	req.Header.Set("X-Request-Id", "r1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, decoded, &embeddingRequest{BaseRequest{RequestID: "r1", Locale: "en"}, "thing"})
+
+	req = newTestRequest("POST", "/things", strings.NewReader("request_id=r2&locale=fr&name=form"), "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, decoded, &embeddingRequest{BaseRequest{RequestID: "r2", Locale: "fr"}, "form"})
+}
+
+func TestBindEmbeddedPointer(t *testing.T) {
+	v := &struct {
+		*BaseRequest
+		Page int
+	}{}
+	values, err := url.ParseQuery("locale=de&page=3")
+	assert.NoError(t, err)
+	assert.NoError(t, bindValues(values, v, "query"))
+	assert.Equal(t, v.Locale, "de")
+	assert.Equal(t, v.Page, 3)
+}
+
+func TestBindValuesCommaSeparated(t *testing.T) {
+	v := &struct {
+		IDs   []int    `query:"ids,comma"`
+		Names []string `query:",comma"`
+		Tags  []string `query:"tag"`
+	}{}
+	values, err := url.ParseQuery("ids=1,2,3&names=a,b&tag=x,y")
+	assert.NoError(t, err)
+	assert.NoError(t, bindValues(values, v, "query"))
+	assert.Equal(t, v.IDs, []int{1, 2, 3})
+	assert.Equal(t, v.Names, []string{"a", "b"})
+	assert.Equal(t, v.Tags, []string{"x,y"})
+
+	values, err = url.ParseQuery("ids=1,x")
+	assert.NoError(t, err)
+	assert.Error(t, bindValues(values, v, "query"))
+}
+
+type updateThing struct {
+	ID      int `path:"id"`
+	Name    string
+	Limit   int `query:"limit"`
+	Version int `header:"If-Match-Version"`
+}
+
+func TestMustBind(t *testing.T) {
+	var bound updateThing
+	s := NewService("/")
+	s.Put().Path("things/{id}").ToFunction(func(cx *Context, id string) {
+		bound = updateThing{}
+		if !cx.MustBind(&bound) {
+			return
+		}
+		cx.RespondWithStatus(http.StatusOK)
+	})
+
+	req := newTestRequest("PUT", "/things/12?limit=5", strings.NewReader(`{"Name": "widget"}`), "application/json")
+	req.Header.Set("If-Match-Version", "3")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, bound, updateThing{ID: 12, Name: "widget", Limit: 5, Version: 3})
+
+	// Untagged fields can not be set from the query.
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("PUT", "/things/12?name=evil&Name=evil", strings.NewReader(`{"Name": "widget"}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, bound.Name, "widget")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("PUT", "/things/twelve", strings.NewReader(`{"Name": "widget"}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.Fields[0].Field, "id")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("PUT", "/things/12", strings.NewReader(`{"Name": 1}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).Fields[0].Field, "Name")
+
+	s.MaxBodyBytes = 8
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("PUT", "/things/12", strings.NewReader(`{"Name": "widget"}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,191 @@
+package webservice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Supported response encodings, in order of server preference.
+var compressionEncodings = []string{"br", "gzip"}
+
+// Choose a response encoding from an Accept-Encoding header. The client's
+// q-values take precedence, with ties going to the server's preference. An
+// empty string means identity.
+func chooseEncoding(acceptEncoding string) string {
+	weights := encodingWeights(acceptEncoding)
+	best := ""
+	bestQ := 0.0
+	for _, coding := range compressionEncodings {
+		q, ok := weights[coding]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// Whether an Accept-Encoding header accepts coding.
+func acceptsEncoding(acceptEncoding, coding string) bool {
+	weights := encodingWeights(acceptEncoding)
+	q, ok := weights[coding]
+	if !ok {
+		q = weights["*"]
+	}
+	return q > 0
+}
+
+// The q-value of each coding in an Accept-Encoding header.
+func encodingWeights(acceptEncoding string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		weights[coding] = q
+	}
+	return weights
+}
+
+// A ResponseWriter that compresses the body with the negotiated encoding.
+// The compressor is only created once a body is written, so bodiless
+// responses are left untouched, as are partial responses, whose
+// Content-Range counts identity bytes.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding      string
+	writer        io.WriteCloser
+	headerWritten bool
+	bodyless      bool
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string) *compressWriter {
+	addVary(w.Header(), "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.headerWritten {
+		return
+	}
+	c.headerWritten = true
+	c.bodyless = status < 200 || status == http.StatusNoContent || status == http.StatusNotModified
+	partial := status == http.StatusPartialContent || c.Header().Get("Content-Range") != ""
+	if !c.bodyless && !partial && c.Header().Get("Content-Encoding") == "" {
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.Header().Del("Content-Length")
+	} else {
+		c.encoding = ""
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.headerWritten {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoding == "" {
+		return c.ResponseWriter.Write(b)
+	}
+	if c.writer == nil {
+		switch c.encoding {
+		case "br":
+			c.writer = brotli.NewWriter(c.ResponseWriter)
+		default:
+			c.writer = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	return c.writer.Write(b)
+}
+
+// Send buffered compressed data to the client, for handlers that stream.
+func (c *compressWriter) Flush() {
+	// Flushing commits the headers, so they must describe the encoding.
+	if !c.headerWritten {
+		c.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := c.writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Flush any compressed data. Must be called once the handler is done.
+func (c *compressWriter) Close() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Close()
+}
+
+// Take over the connection, eg. for websocket upgrades, if the underlying
+// writer supports it.
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
+// Allow http.ResponseController to reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+var UnsupportedContentEncoding = errors.New("unsupported content encoding")
+
+// A decoded request body that closes the original body.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Replace the body of req with one that undoes its Content-Encoding. Layered
+// encodings (eg. "gzip, br") are removed in reverse order of application,
+// leaving the bytes described by Content-Type.
+func decodeContentEncoding(req *http.Request) error {
+	header := req.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+	codings := strings.Split(header, ",")
+	var reader io.Reader = req.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "identity", "":
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				return err
+			}
+			reader = gz
+		case "br":
+			reader = brotli.NewReader(reader)
+		default:
+			return UnsupportedContentEncoding
+		}
+	}
+	req.Body = &decodedBody{reader, req.Body}
+	req.Header.Del("Content-Encoding")
+	req.ContentLength = -1
+	return nil
+}
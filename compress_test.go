@@ -0,0 +1,229 @@
+package webservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchrcom/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	assert.Equal(t, chooseEncoding("br, gzip"), "br")
+	assert.Equal(t, chooseEncoding("gzip, br"), "br")
+	assert.Equal(t, chooseEncoding("br;q=0.5, gzip"), "gzip")
+	assert.Equal(t, chooseEncoding("gzip"), "gzip")
+	assert.Equal(t, chooseEncoding("*"), "br")
+	assert.Equal(t, chooseEncoding("br;q=0, *"), "gzip")
+	assert.Equal(t, chooseEncoding("deflate"), "")
+	assert.Equal(t, chooseEncoding(""), "")
+}
+
+func testCompressedResponse(t *testing.T, acceptEncoding string) *httptest.ResponseRecorder {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData(strings.Repeat("thing", 100))
+	})
+	req := newTestRequest("GET", "/thing", nil, "application/json")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	return writer
+}
+
+func TestCompressBrotli(t *testing.T) {
+	writer := testCompressedResponse(t, "br, gzip")
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "br")
+	assert.Equal(t, writer.Header().Values("Vary"), []string{"Accept-Encoding", "Accept"})
+	body, err := ioutil.ReadAll(brotli.NewReader(writer.Body))
+	assert.NoError(t, err)
+	resp := &Response{}
+	assert.NoError(t, json.Unmarshal(body, resp))
+	assert.Equal(t, resp.D, strings.Repeat("thing", 100))
+}
+
+func TestCompressGzip(t *testing.T) {
+	writer := testCompressedResponse(t, "gzip")
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "gzip")
+	reader, err := gzip.NewReader(writer.Body)
+	assert.NoError(t, err)
+	resp := &Response{}
+	assert.NoError(t, json.NewDecoder(reader).Decode(resp))
+	assert.Equal(t, resp.D, strings.Repeat("thing", 100))
+}
+
+func TestCompressIdentity(t *testing.T) {
+	writer := testCompressedResponse(t, "")
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "")
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.D, strings.Repeat("thing", 100))
+}
+
+func TestDisableCompression(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("thing").DisableCompression().ToFunction(func(cx *Context) {
+		cx.RespondWithData(strings.Repeat("thing", 100))
+	})
+	req := newTestRequest("GET", "/thing", nil, "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "")
+	resp := &Response{}
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), resp))
+	assert.Equal(t, resp.D, strings.Repeat("thing", 100))
+}
+
+func gzipMsgpack(t *testing.T, v interface{}) *bytes.Buffer {
+	body := &bytes.Buffer{}
+	gz := gzip.NewWriter(body)
+	assert.NoError(t, Serializers.Encode("application/x-msgpack", gz, v))
+	assert.NoError(t, gz.Close())
+	return body
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	received := []*Req{}
+	s := NewService("/")
+	s.Post().Path("decoded").DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {
+		received = append(received, req)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.Post().Path("received").ToFunction(func(cx *Context) {
+		req := &Req{}
+		if cx.MustReceive(req) {
+			received = append(received, req)
+			cx.RespondWithStatus(http.StatusOK)
+		}
+	})
+	for _, path := range []string{"/decoded", "/received"} {
+		req := newTestRequest("POST", path, gzipMsgpack(t, &Req{Seen: true, Message: "hello"}), "application/x-msgpack")
+		req.Header.Set("Content-Encoding", "gzip")
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusOK, path)
+	}
+	assert.Equal(t, received, []*Req{{Seen: true, Message: "hello"}, {Seen: true, Message: "hello"}})
+
+	req := newTestRequest("POST", "/decoded", strings.NewReader("{}"), "application/json")
+	req.Header.Set("Content-Encoding", "compress")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusUnsupportedMediaType)
+}
+
+func TestDecodeLayeredContentEncoding(t *testing.T) {
+	body := &bytes.Buffer{}
+	br := brotli.NewWriter(body)
+	_, err := gzipMsgpack(t, &Req{Message: "layered"}).WriteTo(br)
+	assert.NoError(t, err)
+	assert.NoError(t, br.Close())
+	req := newTestRequest("POST", "/", body, "application/x-msgpack")
+	req.Header.Set("Content-Encoding", "gzip, br")
+	assert.NoError(t, decodeContentEncoding(req))
+	v := &Req{}
+	assert.NoError(t, Serializers.DecodeRequest(req, v))
+	assert.Equal(t, v.Message, "layered")
+}
+
+func TestCompressHandlerFunc(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("report").ToHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, "a,b\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "1,2\n")
+	})
+	req := newTestRequest("GET", "/report", nil, "")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "gzip")
+	assert.True(t, writer.Flushed)
+	reader, err := gzip.NewReader(writer.Body)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), "a,b\n1,2\n")
+}
+
+func TestCompressFlushBeforeWrite(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("events").ToHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "first\n")
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+"/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "gzip")
+	reader, err := gzip.NewReader(resp.Body)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), "first\n")
+}
+
+func TestCompressVaryOnce(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("thing").ToFunction(func(cx *Context) { cx.PassThrough() })
+	s.Get().Path("thing").ToFunction(func(cx *Context) { cx.RespondWithData("thing") })
+	req := newTestRequest("GET", "/thing", nil, "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Values("Vary"), []string{"Accept-Encoding", "Accept"})
+}
+
+func TestCompressHijack(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("ws").ToHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := http.NewResponseController(w).Hijack()
+		assert.NoError(t, err)
+		_, ok := w.(http.Hijacker)
+		assert.True(t, ok)
+	})
+	req := newTestRequest("GET", "/ws", nil, "")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	s.ServeHTTP(writer, req)
+	assert.True(t, writer.hijacked)
+}
+
+func TestCompressSkipsPartialContent(t *testing.T) {
+	s := NewService("/")
+	s.Compress = true
+	s.Get().Path("stream").ToFunction(func(cx *Context) {
+		cx.RespondWithReader(http.StatusOK, "text/plain", strings.NewReader("streamed body"))
+	})
+	req := newTestRequest("GET", "/stream", nil, "")
+	req.Header.Set("Range", "bytes=9-")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusPartialContent)
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "")
+	assert.Equal(t, writer.Header().Get("Content-Range"), "bytes 9-12/13")
+	assert.Equal(t, writer.Body.String(), "body")
+}
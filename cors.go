@@ -0,0 +1,109 @@
+package webservice
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Methods allowed for routes that match any method.
+var allMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// Cross-origin resource sharing configuration for a Service.
+type CORSOptions struct {
+	// Origins allowed to make cross-origin requests. "*" allows any origin.
+	AllowedOrigins []string
+	// Request headers allowed in preflighted requests. If empty, the headers
+	// requested by the client are allowed.
+	AllowedHeaders []string
+	// Response headers exposed to the client.
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// How long, in seconds, clients may cache preflight responses.
+	MaxAge int
+}
+
+func (c *CORSOptions) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the CORS headers common to preflight and actual requests. Returns
+// false if the request is not an allowed cross-origin request.
+func (c *CORSOptions) setOriginHeaders(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || !c.allowsOrigin(origin) {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) != 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+	return true
+}
+
+// The methods of all routes matching path.
+func (s *Service) allowedMethods(path string) []string {
+	seen := map[string]bool{}
+	methods := []string{}
+	add := func(method string) {
+		if !seen[method] {
+			seen[method] = true
+			methods = append(methods, method)
+		}
+	}
+	for _, route := range s.currentRoutes() {
+		if route.matchPattern(path) == nil {
+			continue
+		}
+		if route.anyMethod || len(route.methods) == 0 {
+			for _, method := range allMethods {
+				add(method)
+			}
+		}
+		for _, method := range route.methods {
+			add(method)
+		}
+	}
+	if len(methods) != 0 {
+		add("OPTIONS")
+	}
+	return methods
+}
+
+// Respond to an OPTIONS request for a path served by methods, including
+// CORS preflight headers if CORS is enabled.
+func (s *Service) respondOptions(w http.ResponseWriter, req *http.Request, methods []string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	requestMethod := req.Header.Get("Access-Control-Request-Method")
+	if s.CORS == nil || req.Header.Get("Origin") == "" || requestMethod == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	allowed := false
+	for _, method := range methods {
+		allowed = allowed || method == requestMethod
+	}
+	if !allowed || !s.CORS.setOriginHeaders(w, req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(s.CORS.AllowedHeaders) != 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.CORS.AllowedHeaders, ", "))
+	} else if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if s.CORS.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(s.CORS.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newCORSService() *Service {
+	s := NewService("/")
+	s.AutoOptions = true
+	s.CORS = &CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		MaxAge:         600,
+	}
+	s.Get().Path("users/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData(id)
+	})
+	s.Put().Path("users/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData(id)
+	})
+	return s
+}
+
+func TestAutoOptions(t *testing.T) {
+	s := newCORSService()
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("OPTIONS", "/users/1", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusNoContent)
+	assert.Equal(t, writer.Header().Get("Allow"), "GET, PUT, OPTIONS")
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Origin"), "")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("OPTIONS", "/groups/1", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+}
+
+func TestAutoOptionsPreflight(t *testing.T) {
+	s := newCORSService()
+	req := newTestRequest("OPTIONS", "/users/1", nil, "")
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusNoContent)
+	assert.Equal(t, writer.Header().Get("Allow"), "GET, PUT, OPTIONS")
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Methods"), "GET, PUT, OPTIONS")
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Headers"), "Content-Type, Authorization")
+	assert.Equal(t, writer.Header().Get("Access-Control-Max-Age"), "600")
+}
+
+func TestAutoOptionsPreflightRejected(t *testing.T) {
+	s := newCORSService()
+	req := newTestRequest("OPTIONS", "/users/1", nil, "")
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusForbidden)
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Origin"), "")
+
+	req = newTestRequest("OPTIONS", "/users/1", nil, "")
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusForbidden)
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	s := newCORSService()
+	req := newTestRequest("GET", "/users/1", nil, "application/json")
+	req.Header.Set("Origin", "https://app.example.com")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+}
@@ -0,0 +1,23 @@
+package webservice
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"strings"
+)
+
+// Serve expvar at {prefix}/vars and the net/http/pprof handlers under
+// {prefix}/pprof/, relative to the service root. Only call this for services
+// that are not exposed publicly.
+func (s *Service) EnableDebug(prefix string) {
+	prefix = strings.Trim(prefix, "/")
+	s.Get().Path(prefix + "/vars").Named("debug-vars").ToHandler(expvar.Handler())
+	s.Get().Path(prefix + "/pprof/").Named("debug-pprof").ToHandlerFunc(pprof.Index)
+	s.Get().Path(prefix + "/pprof/cmdline").ToHandlerFunc(pprof.Cmdline)
+	s.Get().Path(prefix + "/pprof/profile").ToHandlerFunc(pprof.Profile)
+	s.Post().Get().Path(prefix + "/pprof/symbol").ToHandlerFunc(pprof.Symbol)
+	s.Get().Path(prefix + "/pprof/trace").ToHandlerFunc(pprof.Trace)
+	s.Get().Path(prefix + "/pprof/{profile}").ToFunction(func(cx *Context, profile string) {
+		pprof.Handler(profile).ServeHTTP(cx.ResponseWriter, cx.Request)
+	})
+}
@@ -0,0 +1,28 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnableDebug(t *testing.T) {
+	s := NewService("/api")
+	s.EnableDebug("/_debug")
+	for _, path := range []string{"/api/_debug/vars", "/api/_debug/pprof/", "/api/_debug/pprof/goroutine"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, ""))
+		assert.Equal(t, writer.Code, http.StatusOK, path)
+	}
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/api/_debug/vars", nil, ""))
+	assert.Contains(t, writer.Body.String(), `"memstats"`)
+}
+
+func TestDebugDisabledByDefault(t *testing.T) {
+	s := NewService("/api")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/api/_debug/vars", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+}
@@ -0,0 +1,158 @@
+package webservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// A problem with a single field of a request.
+type FieldError struct {
+	Field   string `json:"field" msgpack:"field" bson:"field"`
+	Message string `json:"message" msgpack:"message" bson:"message"`
+}
+
+// An error decoding or validating a request, with details for each invalid
+// field. Responding with a DecodeError includes the fields in the envelope.
+type DecodeError struct {
+	Fields []FieldError
+}
+
+func (d *DecodeError) Add(field, message string) {
+	d.Fields = append(d.Fields, FieldError{Field: field, Message: message})
+}
+
+// Add the fields of err, a *DecodeError, with their names prefixed. Other
+// errors are added under the prefix itself.
+func (d *DecodeError) merge(prefix string, err error) {
+	nested, ok := err.(*DecodeError)
+	if !ok {
+		d.Add(strings.TrimSuffix(prefix, "."), err.Error())
+		return
+	}
+	for _, field := range nested.Fields {
+		d.Add(prefix+field.Field, field.Message)
+	}
+}
+
+func (d *DecodeError) Error() string {
+	messages := make([]string, 0, len(d.Fields))
+	for _, field := range d.Fields {
+		messages = append(messages, field.Field+": "+field.Message)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+// Decoded requests implementing Validator are validated before dispatch. A
+// failed validation responds with 422 Unprocessable Entity. Return a
+// *DecodeError to report individual fields.
+type Validator interface {
+	Validate() error
+}
+
+// Convert serializer errors that identify a field into a *DecodeError.
+func asDecodeError(err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		decodeErr := &DecodeError{}
+		decodeErr.Add(typeErr.Field, "expected "+typeErr.Type.String()+" but got "+typeErr.Value)
+		return decodeErr
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, unquoteErr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if unquoteErr == nil {
+			decodeErr := &DecodeError{}
+			decodeErr.Add(field, "unknown field")
+			return decodeErr
+		}
+	}
+	return err
+}
+
+// Respond with err as the error message. Field details of a *DecodeError
+// are included in the response.
+func (c *Context) RespondWithError(status int, err error) error {
+	status, claimErr := c.claimResponse(status)
+	if claimErr != nil {
+		return claimErr
+	}
+	response := &Response{S: status, E: err.Error()}
+	if decodeErr, ok := err.(*DecodeError); ok {
+		response.Fields = decodeErr.Fields
+	}
+	return c.encode(response)
+}
+
+// Respond with 500 Internal Server Error without exposing err to the client.
+// err and the current stack are logged alongside a short error ID, which is
+// returned to the client in the envelope's error_id for correlation.
+func (c *Context) InternalError(err error) error {
+	id := newErrorID()
+	c.logf("internal error %s: %s %s: %s\n%s", id, c.Request.Method, c.Request.URL, err, debug.Stack())
+	status, claimErr := c.claimResponse(http.StatusInternalServerError)
+	if claimErr != nil {
+		return claimErr
+	}
+	return c.encode(&Response{S: status, E: "internal server error", ErrorID: id})
+}
+
+// A destination for the service's logging. *log.Logger implements Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Log to the service's Logger, or the standard logger.
+func (c *Context) logf(format string, args ...interface{}) {
+	if c.service != nil && c.service.Logger != nil {
+		c.service.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func newErrorID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Errors implementing HTTPError are responded to by Context.Error with their
+// own status code.
+type HTTPError interface {
+	error
+	StatusCode() int
+}
+
+type errorMapping struct {
+	target error
+	status int
+}
+
+// Respond with status from Context.Error for errors matching target, as
+// determined by errors.Is. Mappings are checked in registration order.
+func (s *Service) MapError(target error, status int) {
+	s.errorMappings = append(s.errorMappings, errorMapping{target, status})
+}
+
+// Respond with err, using the status of an HTTPError or of the first
+// service error mapping matching err. Other errors are treated as internal
+// errors, with InternalError.
+func (c *Context) Error(err error) error {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return c.RespondWithError(httpErr.StatusCode(), err)
+	}
+	if c.service != nil {
+		for _, mapping := range c.service.errorMappings {
+			if errors.Is(err, mapping.target) {
+				return c.RespondWithError(mapping.status, err)
+			}
+		}
+	}
+	return c.InternalError(err)
+}
@@ -0,0 +1,189 @@
+package webservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type signup struct {
+	Name  string
+	Email string
+	Age   int
+}
+
+func (s *signup) Validate() error {
+	err := &DecodeError{}
+	if s.Name == "" {
+		err.Add("Name", "is required")
+	}
+	if !strings.Contains(s.Email, "@") {
+		err.Add("Email", "must be an email address")
+	}
+	if len(err.Fields) != 0 {
+		return err
+	}
+	return nil
+}
+
+func newSignupService(called *bool) *Service {
+	s := NewService("/")
+	s.Post().Path("signup").DecodeRequest(&signup{}).ToFunction(func(cx *Context, req *signup) {
+		*called = true
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	return s
+}
+
+func TestValidationFieldErrors(t *testing.T) {
+	called := false
+	s := newSignupService(&called)
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Name": "", "Email": "nope"}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/signup", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusUnprocessableEntity)
+	assert.False(t, called)
+	assert.Contains(t, writer.Body.String(), `"fields":[`)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.Fields, []FieldError{
+		{Field: "Name", Message: "is required"},
+		{Field: "Email", Message: "must be an email address"},
+	})
+}
+
+func TestDecodeFieldErrors(t *testing.T) {
+	called := false
+	s := newSignupService(&called)
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Name": "bob", "Email": "bob@example.com", "Age": "old"}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/signup", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.False(t, called)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, len(resp.Fields), 1)
+	assert.Equal(t, resp.Fields[0].Field, "Age")
+}
+
+func TestValidationPasses(t *testing.T) {
+	called := false
+	s := newSignupService(&called)
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Name": "bob", "Email": "bob@example.com"}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/signup", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.True(t, called)
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	called := false
+	s := newSignupService(&called)
+	s.DisallowUnknownFields = true
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Name": "bob", "Email": "bob@example.com", "Admin": true}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/signup", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.False(t, called)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.Fields, []FieldError{{Field: "Admin", Message: "unknown field"}})
+
+	s.DisallowUnknownFields = false
+	writer = httptest.NewRecorder()
+	body = strings.NewReader(`{"Name": "bob", "Email": "bob@example.com", "Admin": true}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/signup", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.True(t, called)
+}
+
+func TestInternalErrorID(t *testing.T) {
+	logs := &bytes.Buffer{}
+	s := NewService("/")
+	s.Logger = log.New(logs, "", 0)
+	s.Get().Path("fail").ToFunction(func(cx *Context) {
+		cx.InternalError(errors.New("database password rejected"))
+	})
+	s.Get().Path("panic").ToFunction(func(cx *Context) {
+		panic("nil map")
+	})
+
+	for _, test := range []struct {
+		path   string
+		detail string
+	}{
+		{"/fail", "database password rejected"},
+		{"/panic", "panic: nil map"},
+	} {
+		logs.Reset()
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", test.path, nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusInternalServerError)
+		assert.NotContains(t, writer.Body.String(), test.detail)
+		resp := decodeTestResponse(t, "application/json", writer, nil)
+		assert.Equal(t, resp.E, "internal server error")
+		assert.NotEqual(t, resp.ErrorID, "")
+		assert.Contains(t, logs.String(), "internal error "+resp.ErrorID+": GET "+test.path+": "+test.detail)
+	}
+}
+
+type capturingLogger struct {
+	lines []string
+}
+
+func (l *capturingLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	s := NewService("/")
+	s.Logger = logger
+	s.Get().Path("things/{id}").ToFunction(func(cx *Context) {})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/things/1", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusInternalServerError)
+	assert.Equal(t, len(logger.lines), 1)
+	assert.Contains(t, logger.lines[0], "invalid number of arguments")
+	assert.Contains(t, logger.lines[0], "GET /things/1")
+}
+
+var errNotFound = errors.New("not found")
+
+type conflictError struct{}
+
+func (conflictError) Error() string   { return "conflict" }
+func (conflictError) StatusCode() int { return http.StatusConflict }
+
+func TestContextError(t *testing.T) {
+	s := NewService("/")
+	s.Logger = log.New(&bytes.Buffer{}, "", 0)
+	s.MapError(errNotFound, http.StatusNotFound)
+	s.Get().Path("things/{err}").ToFunction(func(cx *Context, name string) {
+		switch name {
+		case "missing":
+			cx.Error(fmt.Errorf("thing 12: %w", errNotFound))
+		case "conflict":
+			cx.Error(conflictError{})
+		default:
+			cx.Error(errors.New("boom"))
+		}
+	})
+	for _, test := range []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/things/missing", http.StatusNotFound, "thing 12: not found"},
+		{"/things/conflict", http.StatusConflict, "conflict"},
+		{"/things/other", http.StatusInternalServerError, "internal server error"},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", test.path, nil, "application/json"))
+		assert.Equal(t, writer.Code, test.status, test.path)
+		assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).E, test.err)
+	}
+}
@@ -0,0 +1,32 @@
+package webservice
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Check the request's If-Match header against current, the resource's
+// current entity tag, before applying an update. If the header is absent or
+// no listed tag matches, respond with 412 Precondition Failed, including
+// the current ETag, and return false. current is quoted if necessary.
+// Weak tags never match, per the strong comparison If-Match requires.
+func (c *Context) RequireETag(current string) bool {
+	current = quoteETag(current)
+	ifMatch := strings.Join(c.Request.Header.Values("If-Match"), ",")
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (tag == current && !strings.HasPrefix(tag, "W/")) {
+			return true
+		}
+	}
+	c.ResponseWriter.Header().Set("ETag", current)
+	c.RespondWithErrorMessage("precondition failed", http.StatusPreconditionFailed)
+	return false
+}
+
+func quoteETag(tag string) string {
+	if strings.HasPrefix(tag, `"`) || strings.HasPrefix(tag, `W/"`) {
+		return tag
+	}
+	return `"` + tag + `"`
+}
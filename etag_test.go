@@ -0,0 +1,40 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireETag(t *testing.T) {
+	s := NewService("/")
+	s.Put().Path("things/1").ToFunction(func(cx *Context) {
+		if cx.RequireETag("v2") {
+			cx.RespondWithStatus(http.StatusOK)
+		}
+	})
+	for _, test := range []struct {
+		ifMatch string
+		status  int
+	}{
+		{`"v2"`, http.StatusOK},
+		{`"v1", "v2"`, http.StatusOK},
+		{`*`, http.StatusOK},
+		{`"v1"`, http.StatusPreconditionFailed},
+		{`W/"v2"`, http.StatusPreconditionFailed},
+		{``, http.StatusPreconditionFailed},
+	} {
+		req := newTestRequest("PUT", "/things/1", strings.NewReader("{}"), "application/json")
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, test.status, test.ifMatch)
+		if test.status == http.StatusPreconditionFailed {
+			assert.Equal(t, writer.Header().Get("ETag"), `"v2"`)
+		}
+	}
+}
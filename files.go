@@ -0,0 +1,113 @@
+package webservice
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Serve the files under dir at prefix, eg. s.Static("/assets", "./public").
+// If the client accepts gzip and a precompressed file.gz exists alongside a
+// requested file, it is served instead with Content-Encoding: gzip.
+// Directories are not served.
+func (s *Service) Static(prefix, dir string) *Route {
+	root := http.Dir(dir)
+	return s.Get().Path(strings.TrimRight(prefix, "/") + "/{path...}").KeepExtension().ToFunction(func(cx *Context, name string) {
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			respondFileNotFound(cx)
+			return
+		}
+		name = path.Clean("/" + name)
+		addVary(cx.ResponseWriter.Header(), "Accept-Encoding")
+		if acceptsEncoding(cx.Request.Header.Get("Accept-Encoding"), "gzip") && serveFile(cx, root, name, true) {
+			return
+		}
+		if !serveFile(cx, root, name, false) {
+			respondFileNotFound(cx)
+		}
+	})
+}
+
+// Respond with 404, in plain text if the request does not determine a
+// response format, as browsers and plain HTTP clients fetching assets don't.
+func respondFileNotFound(cx *Context) {
+	if cx.NegotiatedContentType() != "" {
+		cx.RespondWithStatus(http.StatusNotFound)
+		return
+	}
+	if _, err := cx.claimResponse(http.StatusNotFound); err == nil {
+		writePlainTextError(cx.ResponseWriter, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+}
+
+// Serve the regular file at name in root, or its precompressed name.gz
+// with Content-Encoding: gzip, returning false if there is none.
+func serveFile(cx *Context, root http.FileSystem, name string, gzipped bool) bool {
+	open := name
+	if gzipped {
+		open += ".gz"
+	}
+	file, err := root.Open(open)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	if gzipped {
+		cx.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+	}
+	// The content type is determined by name, not the precompressed file.
+	http.ServeContent(cx.ResponseWriter, cx.Request, name, info.ModTime(), file)
+	return true
+}
+
+// Serve dir at prefix with http.FileServer. If listDir is false, directories
+// without an index.html respond with 404 Not Found rather than a listing.
+func (s *Service) ServeFiles(prefix, dir string, listDir bool) *Route {
+	var root http.FileSystem = http.Dir(dir)
+	if !listDir {
+		root = noListingFileSystem{root}
+	}
+	server := http.FileServer(root)
+	return s.Get().Path(strings.TrimRight(prefix, "/") + "/{path...?}").KeepExtension().ToFunction(func(cx *Context, name string) {
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			respondFileNotFound(cx)
+			return
+		}
+		req := cx.Request.Clone(cx.Request.Context())
+		req.URL.Path = "/" + name
+		req.URL.RawPath = ""
+		server.ServeHTTP(cx.ResponseWriter, req)
+	})
+}
+
+// A FileSystem that hides directories without an index.html, so that
+// http.FileServer does not list them.
+type noListingFileSystem struct {
+	http.FileSystem
+}
+
+func (n noListingFileSystem) Open(name string) (http.File, error) {
+	file, err := n.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.IsDir() {
+		return file, err
+	}
+	index, err := n.FileSystem.Open(path.Join(name, "index.html"))
+	if err != nil {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	index.Close()
+	return file, nil
+}
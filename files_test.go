@@ -0,0 +1,121 @@
+package webservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchrcom/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte("console.log('compressed')"))
+	gz.Close()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('plain')"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.js.gz"), compressed.Bytes(), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0644))
+	s := NewService("/")
+	s.Static("/assets", dir)
+
+	req := newTestRequest("GET", "/assets/app.js", nil, "")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "gzip")
+	assert.Contains(t, writer.Header().Get("Content-Type"), "javascript")
+	assert.Equal(t, writer.Header().Get("Vary"), "Accept-Encoding")
+	reader, err := gzip.NewReader(writer.Body)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, string(body), "console.log('compressed')")
+
+	for _, acceptEncoding := range []string{"", "gzip;q=0", "br"} {
+		req := newTestRequest("GET", "/assets/app.js", nil, "")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusOK, acceptEncoding)
+		assert.Equal(t, writer.Header().Get("Content-Encoding"), "", acceptEncoding)
+		assert.Equal(t, writer.Body.String(), "console.log('plain')", acceptEncoding)
+	}
+
+	// Files without a precompressed variant are served as they are.
+	req = newTestRequest("GET", "/assets/style.css", nil, "")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Get("Content-Encoding"), "")
+	assert.Equal(t, writer.Body.String(), "body {}")
+
+	// Response compression does not repeat the Vary header.
+	s.Compress = true
+	req = newTestRequest("GET", "/assets/app.js", nil, "")
+	req.Header.Set("Accept-Encoding", "gzip")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Values("Vary"), []string{"Accept-Encoding"})
+	s.Compress = false
+
+	// Extension negotiation does not apply to file names.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"a": 1}`), 0644))
+	s.ExtensionNegotiation = true
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/assets/data.json", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Body.String(), `{"a": 1}`)
+	s.ExtensionNegotiation = false
+
+	// Names are unescaped.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "hello world.txt"), []byte("hello"), 0644))
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/assets/hello%20world.txt", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Body.String(), "hello")
+
+	// Without an Accept header, missing files are a plain text 404.
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/assets/missing.js", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+
+	assert.Equal(t, serveTestData(s, "GET", "/assets/missing.js"), http.StatusNotFound)
+	assert.Equal(t, serveTestData(s, "GET", "/assets/../files_test.go"), http.StatusNotFound)
+}
+
+func TestServeFilesListing(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "docs"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "site"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "guide.txt"), []byte("guide"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "site", "index.html"), []byte("<p>home</p>"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "hello world.txt"), []byte("hello"), 0644))
+	s := NewService("/")
+	s.ServeFiles("/hidden", dir, false)
+	s.ServeFiles("/listed", dir, true)
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/hidden/docs/guide.txt", http.StatusOK, "guide"},
+		{"/hidden/docs/hello%20world.txt", http.StatusOK, "hello"},
+		{"/hidden/docs/", http.StatusNotFound, ""},
+		{"/hidden/", http.StatusNotFound, ""},
+		{"/hidden/site/", http.StatusOK, "<p>home</p>"},
+		{"/listed/docs/", http.StatusOK, "guide.txt"},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", test.path, nil, ""))
+		assert.Equal(t, writer.Code, test.status, test.path)
+		assert.Contains(t, writer.Body.String(), test.body, test.path)
+	}
+}
@@ -0,0 +1,112 @@
+package webservice
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"reflect"
+)
+
+var FormEncodingUnsupported = errors.New("responses can not be encoded as forms")
+
+// Decodes application/x-www-form-urlencoded request bodies into structs. See
+// bindValues for how keys are matched to fields; the struct tag is "form".
+//
+// Forms are only supported for requests and are never chosen as a response
+// content type.
+type FormSerializer struct{}
+
+func (f *FormSerializer) NewEncoder(w io.Writer) ContentTypeEncoder {
+	return &formEncoder{}
+}
+
+func (f *FormSerializer) NewDecoder(r io.Reader) ContentTypeDecoder {
+	return &formDecoder{r}
+}
+
+func (f *FormSerializer) CanEncode() bool {
+	return false
+}
+
+type formEncoder struct{}
+
+func (f *formEncoder) Encode(v interface{}) error {
+	return FormEncodingUnsupported
+}
+
+type formDecoder struct {
+	r io.Reader
+}
+
+func (f *formDecoder) Decode(v interface{}) error {
+	body, err := ioutil.ReadAll(f.r)
+	if err != nil {
+		return err
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	return bindValues(values, v, "form")
+}
+
+// Maximum memory used for multipart form values by the Form* accessors.
+const maxFormMemory = 32 << 20
+
+// Parse the request's form, including multipart bodies, once per request.
+func (c *Context) parseForm() error {
+	if !c.formParsed {
+		c.formParsed = true
+		if mediaType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			c.formErr = c.Request.ParseMultipartForm(maxFormMemory)
+		} else {
+			c.formErr = c.Request.ParseForm()
+		}
+	}
+	return c.formErr
+}
+
+// The first value of the form field name, from the body or query string, or
+// "" if it is missing or the form could not be parsed.
+func (c *Context) FormValue(name string) string {
+	if c.parseForm() != nil {
+		return ""
+	}
+	return c.Request.Form.Get(name)
+}
+
+// The form field name coerced to t, if it is present and valid.
+func (c *Context) formCoerce(name string, t reflect.Type) (reflect.Value, bool) {
+	s := c.FormValue(name)
+	if s == "" {
+		return reflect.Value{}, false
+	}
+	v, err := coerce(s, t)
+	return v, err == nil
+}
+
+// The form field name as an int, or def if it is missing or invalid.
+func (c *Context) FormInt(name string, def int) int {
+	if v, ok := c.formCoerce(name, reflect.TypeOf(def)); ok {
+		return v.Interface().(int)
+	}
+	return def
+}
+
+// The form field name as an int64, or def if it is missing or invalid.
+func (c *Context) FormInt64(name string, def int64) int64 {
+	if v, ok := c.formCoerce(name, reflect.TypeOf(def)); ok {
+		return v.Interface().(int64)
+	}
+	return def
+}
+
+// The form field name as a float64, or def if it is missing or invalid.
+func (c *Context) FormFloat(name string, def float64) float64 {
+	if v, ok := c.formCoerce(name, reflect.TypeOf(def)); ok {
+		return v.Interface().(float64)
+	}
+	return def
+}
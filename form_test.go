@@ -0,0 +1,81 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type formItem struct {
+	Name     string `form:"name"`
+	Quantity int    `form:"quantity"`
+}
+
+type formOrder struct {
+	Customer string     `form:"customer"`
+	Items    []formItem `form:"items"`
+	Address  struct {
+		City string
+	}
+}
+
+func postForm(s *Service, body string) *httptest.ResponseRecorder {
+	req := newTestRequest("POST", "/orders", strings.NewReader(body), "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	return writer
+}
+
+func TestFormIndexedStructs(t *testing.T) {
+	var order *formOrder
+	s := NewService("/")
+	s.Post().Path("orders").DecodeRequest(&formOrder{}).ToFunction(func(cx *Context, req *formOrder) {
+		order = req
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := postForm(s, "customer=bob&items[1].name=b&items[0].name=a&items[0].quantity=2&address.city=Sydney")
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, order.Customer, "bob")
+	assert.Equal(t, order.Items, []formItem{{Name: "a", Quantity: 2}, {Name: "b"}})
+	assert.Equal(t, order.Address.City, "Sydney")
+}
+
+func TestFormIndexedStructErrors(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("orders").DecodeRequest(&formOrder{}).ToFunction(func(cx *Context, req *formOrder) {})
+	writer := postForm(s, "items[0].name=a&items[1].quantity=many")
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, len(resp.Fields), 1)
+	assert.Equal(t, resp.Fields[0].Field, "items[1].quantity")
+}
+
+func TestFormIsNotNegotiatedForResponses(t *testing.T) {
+	_, _, ok := Serializers.negotiate("", "application/x-www-form-urlencoded")
+	assert.False(t, ok)
+}
+
+func TestFormValues(t *testing.T) {
+	var name string
+	var quantity, missing, invalid int
+	var price float64
+	s := NewService("/")
+	s.Post().Path("orders").ToFunction(func(cx *Context) {
+		name = cx.FormValue("name")
+		quantity = cx.FormInt("quantity", 1)
+		missing = cx.FormInt("missing", 7)
+		invalid = cx.FormInt("invalid", 3)
+		price = cx.FormFloat("price", 0)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := postForm(s, "name=widget&quantity=4&invalid=x&price=2.5")
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, name, "widget")
+	assert.Equal(t, quantity, 4)
+	assert.Equal(t, missing, 7)
+	assert.Equal(t, invalid, 3)
+	assert.Equal(t, price, 2.5)
+}
@@ -0,0 +1,73 @@
+package webservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A single JSON Patch (RFC 6902) operation.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Serializer for application/json-patch+json documents. Decoding into a
+// *[]PatchOp validates each operation.
+//
+// Patches are only supported for requests and are never chosen as a
+// response content type.
+type JsonPatchSerializer struct{}
+
+func (j *JsonPatchSerializer) NewEncoder(w io.Writer) ContentTypeEncoder {
+	return json.NewEncoder(w)
+}
+
+func (j *JsonPatchSerializer) CanEncode() bool {
+	return false
+}
+
+func (j *JsonPatchSerializer) NewDecoder(r io.Reader) ContentTypeDecoder {
+	return &jsonPatchDecoder{json.NewDecoder(r)}
+}
+
+type jsonPatchDecoder struct {
+	decoder *json.Decoder
+}
+
+func (j *jsonPatchDecoder) Decode(v interface{}) error {
+	if err := j.decoder.Decode(v); err != nil {
+		return err
+	}
+	if ops, ok := v.(*[]PatchOp); ok {
+		return validatePatch(*ops)
+	}
+	return nil
+}
+
+func validatePatch(ops []PatchOp) error {
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "remove", "replace", "test":
+		case "move", "copy":
+			if op.From == "" {
+				return fmt.Errorf("patch operation %d (%s) is missing \"from\"", i, op.Op)
+			}
+		default:
+			return fmt.Errorf("patch operation %d has invalid op %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// Decode the request body as a JSON Patch document. Handlers are
+// responsible for applying the operations.
+func (c *Context) ReceivePatch() ([]PatchOp, error) {
+	ops := []PatchOp{}
+	if err := c.Receive(&ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
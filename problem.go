@@ -0,0 +1,34 @@
+package webservice
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// An RFC 7807 problem details document.
+type Problem struct {
+	Type     string `json:"type,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Respond with problem as application/problem+json, rather than the
+// response envelope. problem.Status defaults to status, and problem.Title
+// to the status text.
+func (c *Context) RespondProblem(status int, problem Problem) error {
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
+	if problem.Status == 0 {
+		problem.Status = status
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(status)
+	}
+	c.ResponseWriter.Header().Set("Content-Type", "application/problem+json")
+	c.ResponseWriter.WriteHeader(status)
+	return json.NewEncoder(c.ResponseWriter).Encode(problem)
+}
@@ -0,0 +1,40 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondProblem(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("transfers").ToFunction(func(cx *Context) {
+		cx.RespondProblem(http.StatusForbidden, Problem{
+			Type:     "https://example.com/probs/out-of-credit",
+			Title:    "You do not have enough credit.",
+			Detail:   "Your current balance is 30, but that costs 50.",
+			Instance: "/account/12345/msgs/abc",
+		})
+	})
+	s.Get().Path("missing").ToFunction(func(cx *Context) {
+		cx.RespondProblem(http.StatusNotFound, Problem{})
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/transfers", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Code, http.StatusForbidden)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/problem+json")
+	assert.JSONEq(t, writer.Body.String(), `{
+		"type": "https://example.com/probs/out-of-credit",
+		"title": "You do not have enough credit.",
+		"status": 403,
+		"detail": "Your current balance is 30, but that costs 50.",
+		"instance": "/account/12345/msgs/abc"
+	}`)
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/missing", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.JSONEq(t, writer.Body.String(), `{"title": "Not Found", "status": 404}`)
+}
@@ -0,0 +1,88 @@
+package webservice
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of client buckets tracked by each rate limited route. The
+// least recently seen clients are evicted first.
+var RateLimitBuckets = 10000
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// A token-bucket rate limiter keyed by client.
+type rateLimiter struct {
+	lock    sync.Mutex
+	rps     float64
+	burst   int
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:     rps,
+		burst:   burst,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Take a token for key at time now. If none are available, returns false and
+// how long until one will be.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var bucket *tokenBucket
+	if element, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		if elapsed > 0 {
+			bucket.tokens = math.Min(float64(l.burst), bucket.tokens+elapsed*l.rps)
+		}
+		bucket.last = now
+	} else {
+		bucket = &tokenBucket{key: key, tokens: float64(l.burst), last: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+		for l.lru.Len() > RateLimitBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rps * float64(time.Second))
+}
+
+// Limit each client IP to rps requests per second, allowing bursts of up to
+// burst requests. Excess requests receive 429 Too Many Requests. Panics
+// unless both rps and burst are positive.
+func (r *Route) RateLimit(rps float64, burst int) *Route {
+	if !(rps > 0) || burst <= 0 {
+		panic(fmt.Sprintf("route %q has rate limit of %v requests per second with burst %d, both must be positive", r.path, rps, burst))
+	}
+	limiter := newRateLimiter(rps, burst)
+	r.middleware = append(r.middleware, func(cx *Context, next func() bool) bool {
+		ok, wait := limiter.allow(cx.ClientIP(), cx.now())
+		if !ok {
+			setRetryAfter(cx.ResponseWriter.Header(), wait)
+			cx.RespondWithStatus(http.StatusTooManyRequests)
+			return true
+		}
+		return next()
+	})
+	return r
+}
@@ -0,0 +1,57 @@
+package webservice
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// A ResponseWriter that records the status sent to the client. After the
+// first failed write, typically because the client went away, further writes
+// are skipped and return the same error.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ResponseWriter.Write(b)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Take over the connection, eg. for websocket upgrades, if the underlying
+// writer supports it.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Allow http.ResponseController to reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,46 @@
+package webservice
+
+import (
+	"bytes"
+	"github.com/xeipuuv/gojsonschema"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// Validate JSON request bodies against a JSON Schema before decoding. Bodies
+// that fail validation are rejected with 422 Unprocessable Entity, listing
+// each schema violation. Panics if schema is invalid.
+func (r *Route) Schema(schema []byte) *Route {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		panic("invalid JSON schema: " + err.Error())
+	}
+	r.middleware = append(r.middleware, func(cx *Context, next func() bool) bool {
+		ct, _, _ := mime.ParseMediaType(cx.Request.Header.Get("Content-Type"))
+		if ct != "application/json" {
+			return next()
+		}
+		body, err := ioutil.ReadAll(cx.Request.Body)
+		if err != nil {
+			cx.RespondWithError(decodeErrorStatus(err), err)
+			return true
+		}
+		cx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		result, err := compiled.Validate(gojsonschema.NewBytesLoader(body))
+		if err != nil {
+			cx.RespondWithError(http.StatusBadRequest, err)
+			return true
+		}
+		if !result.Valid() {
+			decodeErr := &DecodeError{}
+			for _, violation := range result.Errors() {
+				decodeErr.Add(violation.Field(), violation.Description())
+			}
+			cx.RespondWithError(http.StatusUnprocessableEntity, decodeErr)
+			return true
+		}
+		return next()
+	})
+	return r
+}
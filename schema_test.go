@@ -0,0 +1,64 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var reqSchema = []byte(`{
+	"type": "object",
+	"properties": {"Message": {"type": "string"}},
+	"required": ["Message"]
+}`)
+
+func newSchemaService(called *bool) *Service {
+	s := NewService("/")
+	s.Post().Path("thing").Schema(reqSchema).DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {
+		*called = true
+		cx.RespondWithData(req.Message)
+	})
+	return s
+}
+
+func TestSchemaRejectsInvalidBody(t *testing.T) {
+	called := false
+	s := newSchemaService(&called)
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Seen": true}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusUnprocessableEntity)
+	assert.False(t, called)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, len(resp.Fields), 1)
+	assert.Contains(t, resp.Fields[0].Message, "Message")
+}
+
+func TestSchemaAcceptsValidBody(t *testing.T) {
+	called := false
+	s := newSchemaService(&called)
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Message": "hi"}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.True(t, called)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.D, "hi")
+}
+
+func TestSchemaRejectsLargeBody(t *testing.T) {
+	called := false
+	s := NewService("/")
+	s.Post().Path("thing").Schema(reqSchema).MaxBody(16).DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {
+		called = true
+	})
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Message": "` + strings.Repeat("x", 32) + `"}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusRequestEntityTooLarge)
+	assert.False(t, called)
+}
+
+func TestSchemaPanicsOnInvalidSchema(t *testing.T) {
+	assert.Panics(t, func() { NewRoute().Schema([]byte(`{"type": 12}`)) })
+}
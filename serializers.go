@@ -1,32 +1,78 @@
 package webservice
 
 import (
+	"bufio"
+	"bytes"
 	"code.google.com/p/vitess/go/bson"
+	"encoding"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/vmihailenco/msgpack"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
 	Serializers = SerializerMap{
-		"application/json":      &JsonSerializer{},
-		"application/x-msgpack": &MsgpackSerializer{},
-		"application/bson":      &BsonSerializer{},
+		"application/json":                  &JsonSerializer{},
+		"application/x-msgpack":             &MsgpackSerializer{},
+		"application/bson":                  &BsonSerializer{},
+		"application/json-patch+json":       &JsonPatchSerializer{},
+		"application/x-www-form-urlencoded": &FormSerializer{},
 	}
+	// Content types in the order they are preferred during negotiation. See
+	// SerializerMap.
+	SerializerPreference = []string{"application/json", "application/x-msgpack", "application/bson"}
+	// Content type to respond with when the request does not determine one.
+	DefaultContentType     = ""
 	UnsupportedContentType = errors.New("unsupported content type")
 )
 
+// A set of serializers keyed by content type.
+//
+// The response content type is the first of:
+//
+//  1. The media types in the Accept header, by descending q-value. Ties are
+//     broken by SerializerPreference, then by their order in the header.
+//  2. For a wildcard media range, or if there is no Accept header, the
+//     request Content-Type, then DefaultContentType, then, only if the
+//     client sent an Accept header, SerializerPreference.
+//
+// So a request with neither header nor a DefaultContentType is not assigned
+// a format, and is responded to with 400 Bad Request.
 type SerializerMap map[string]Serializer
 
+// A copy of the map with the serializer for ct replaced by ser.
+func (s SerializerMap) With(ct string, ser Serializer) SerializerMap {
+	clone := make(SerializerMap, len(s)+1)
+	for k, v := range s {
+		clone[k] = v
+	}
+	clone[ct] = ser
+	return clone
+}
+
+// Set SerializerPreference, which is shared by all serializer maps.
+func (s SerializerMap) SetPreference(order []string) {
+	SerializerPreference = append([]string(nil), order...)
+}
+
 func (s SerializerMap) DecodeRequest(req *http.Request, v interface{}) error {
 	ct := req.Header.Get("Content-Type")
 	return s.Decode(ct, req.Body, v)
 }
 
 func (s SerializerMap) Decode(ct string, r io.Reader, v interface{}) error {
+	if mediaType, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = mediaType
+	}
 	if ser, ok := s[ct]; ok {
 		decoder := ser.NewDecoder(r)
 		return decoder.Decode(v)
@@ -35,20 +81,207 @@ func (s SerializerMap) Decode(ct string, r io.Reader, v interface{}) error {
 }
 
 func (s SerializerMap) EncodeResponse(req *http.Request, resp http.ResponseWriter, response *Response) error {
-	ct := req.Header.Get("Accept")
-	if ct == "" {
-		ct = req.Header.Get("Content-Type")
-	}
-	resp.Header().Set("Content-Type", ct)
-	// TODO: Figure out ordering here that isn't shit.
-	if ser, ok := s[ct]; ok {
+	accept := req.Header.Get("Accept")
+	ct, ser, ok := s.Negotiate(req)
+	// The response format depends on Accept, so caches must key on it.
+	addVary(resp.Header(), "Accept")
+	if ok {
+		resp.Header().Set("Content-Type", withCharset(ct))
 		resp.WriteHeader(response.S)
 		return s.rawEncode(ser, resp, response)
 	}
-	resp.WriteHeader(http.StatusBadRequest)
+	status := http.StatusBadRequest
+	requested := req.Header.Get("Content-Type")
+	if accept != "" {
+		status = http.StatusNotAcceptable
+		requested = accept
+	}
+	writePlainTextError(resp, status, fmt.Sprintf("%s: %s", UnsupportedContentType, requested))
 	return UnsupportedContentType
 }
 
+// Encode response with the serializer for ct, regardless of the request.
+func (s SerializerMap) EncodeResponseAs(ct string, resp http.ResponseWriter, response *Response) error {
+	ser, ok := s[ct]
+	if !ok {
+		writePlainTextError(resp, http.StatusInternalServerError, fmt.Sprintf("%s: %s", UnsupportedContentType, ct))
+		return UnsupportedContentType
+	}
+	resp.Header().Set("Content-Type", withCharset(ct))
+	resp.WriteHeader(response.S)
+	return s.rawEncode(ser, resp, response)
+}
+
+// Declare UTF-8 on textual content types (text/*, JSON and XML).
+func withCharset(ct string) string {
+	if strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "json") || strings.HasSuffix(ct, "xml") {
+		return ct + "; charset=utf-8"
+	}
+	return ct
+}
+
+// Choose the response content type and serializer for req.
+func (s SerializerMap) Negotiate(req *http.Request) (string, Serializer, bool) {
+	return s.negotiate(req.Header.Get("Accept"), req.Header.Get("Content-Type"))
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// Parse an Accept header into media ranges ordered by descending q-value.
+// Equal q-values are ordered by SerializerPreference, and then by their
+// order in the header.
+func (s SerializerMap) parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return s.rank(ranges[i].mediaType) < s.rank(ranges[j].mediaType)
+	})
+	return ranges
+}
+
+// Position of ct in SerializerPreference. Unlisted types and media ranges
+// rank after all listed types.
+func (s SerializerMap) rank(ct string) int {
+	for i, preferred := range SerializerPreference {
+		if preferred == ct {
+			return i
+		}
+	}
+	return len(SerializerPreference)
+}
+
+// Choose the response content type and serializer for a request with the
+// given Accept and Content-Type headers.
+func (s SerializerMap) negotiate(accept, contentType string) (string, Serializer, bool) {
+	ser, ct, ok := s.chooseSerializer(accept, contentType, DefaultContentType)
+	return ct, ser, ok
+}
+
+// Choose the serializer and content type for a response, given the Accept
+// and Content-Type headers of the request and a default content type (which
+// may be empty) for when they do not determine one.
+func (s SerializerMap) chooseSerializer(accept, contentType, def string) (Serializer, string, bool) {
+	ranges := []acceptRange{{"*/*", 1}}
+	if accept != "" {
+		ranges = s.parseAccept(accept)
+	}
+	// Candidates for wildcard media ranges, in fallback order.
+	candidates := []string{}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		candidates = append(candidates, mediaType)
+	}
+	if def != "" {
+		candidates = append(candidates, def)
+	}
+	if accept != "" {
+		candidates = append(candidates, SerializerPreference...)
+	}
+	for _, r := range ranges {
+		if !strings.HasSuffix(r.mediaType, "/*") {
+			if ser, ok := s.encoder(r.mediaType); ok {
+				return ser, r.mediaType, true
+			}
+			continue
+		}
+		for _, ct := range candidates {
+			if ser, ok := s.encoder(ct); ok && matchMediaRange(r.mediaType, ct) {
+				return ser, ct, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// Choose which of offers, a set of arbitrary content types, best satisfies
+// accept. Wildcard media ranges prefer DefaultContentType, then
+// SerializerPreference, then the remaining offers in lexical order.
+func (s SerializerMap) negotiateOffers(accept string, offers []string) (string, bool) {
+	ranges := []acceptRange{{"*/*", 1}}
+	if accept != "" {
+		ranges = s.parseAccept(accept)
+	}
+	candidates := append([]string(nil), offers...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if (candidates[i] == DefaultContentType) != (candidates[j] == DefaultContentType) {
+			return candidates[i] == DefaultContentType
+		}
+		if ri, rj := s.rank(candidates[i]), s.rank(candidates[j]); ri != rj {
+			return ri < rj
+		}
+		return candidates[i] < candidates[j]
+	})
+	for _, r := range ranges {
+		for _, ct := range candidates {
+			if ct == r.mediaType || (strings.HasSuffix(r.mediaType, "/*") && matchMediaRange(r.mediaType, ct)) {
+				return ct, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Serializers implementing this and returning false are only used for
+// decoding requests.
+type encodingCapability interface {
+	CanEncode() bool
+}
+
+// The serializer for ct, if it can encode responses.
+func (s SerializerMap) encoder(ct string) (Serializer, bool) {
+	ser, ok := s[ct]
+	if !ok {
+		return nil, false
+	}
+	if capability, ok := ser.(encodingCapability); ok && !capability.CanEncode() {
+		return nil, false
+	}
+	return ser, true
+}
+
+func matchMediaRange(mediaRange, ct string) bool {
+	if mediaRange == "*/*" {
+		return true
+	}
+	return strings.HasPrefix(ct, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// Add value to the Vary header unless it is already listed.
+func addVary(header http.Header, value string) {
+	for _, v := range header.Values("Vary") {
+		if v == value {
+			return
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// Fallback for when no serializer can be used to report an error.
+func writePlainTextError(resp http.ResponseWriter, status int, message string) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(status)
+	io.WriteString(resp, message+"\n")
+}
+
 func (s SerializerMap) Encode(ct string, w io.Writer, v interface{}) error {
 	if ser, ok := s[ct]; ok {
 		return s.rawEncode(ser, w, v)
@@ -74,14 +307,94 @@ type Serializer interface {
 	NewDecoder(r io.Reader) ContentTypeDecoder
 }
 
-type JsonSerializer struct{}
+type JsonSerializer struct {
+	// Fail to decode objects with fields not present in the target value.
+	DisallowUnknownFields bool
+	// Indent each level of encoded output with this string.
+	Indent string
+	// Write the elements of slice data in response envelopes as they are
+	// encoded, rather than encoding the whole response before writing it.
+	// An element that fails to encode leaves a truncated response, as the
+	// status has already been sent. Ignored if Indent is set.
+	StreamEnvelope bool
+}
 
 func (j *JsonSerializer) NewEncoder(w io.Writer) ContentTypeEncoder {
-	return json.NewEncoder(w)
+	if j.StreamEnvelope && j.Indent == "" {
+		return &jsonStreamEncoder{w}
+	}
+	encoder := json.NewEncoder(w)
+	if j.Indent != "" {
+		encoder.SetIndent("", j.Indent)
+	}
+	return encoder
 }
 
 func (j *JsonSerializer) NewDecoder(r io.Reader) ContentTypeDecoder {
-	return json.NewDecoder(r)
+	decoder := json.NewDecoder(r)
+	if j.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	return &jsonDecoder{decoder, j.DisallowUnknownFields}
+}
+
+// Encodes *Response values with slice data element by element, producing
+// the same output as json.Encoder. Slices that marshal themselves are
+// encoded whole.
+type jsonStreamEncoder struct {
+	w io.Writer
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (j *jsonStreamEncoder) Encode(v interface{}) error {
+	response, ok := v.(*Response)
+	data := reflect.ValueOf(nil)
+	if ok {
+		data = reflect.ValueOf(response.D)
+	}
+	if !data.IsValid() || data.Kind() != reflect.Slice || data.IsNil() || data.Type().Elem().Kind() == reflect.Uint8 ||
+		data.Type().Implements(jsonMarshalerType) || data.Type().Implements(textMarshalerType) {
+		return json.NewEncoder(j.w).Encode(v)
+	}
+	e, err := json.Marshal(response.E)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(j.w, `{"S":%d,"E":%s,"D":[`, response.S, e); err != nil {
+		return err
+	}
+	for i := 0; i < data.Len(); i++ {
+		element, err := json.Marshal(data.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			element = append([]byte{','}, element...)
+		}
+		if _, err := j.w.Write(element); err != nil {
+			return err
+		}
+	}
+	trailer := &bytes.Buffer{}
+	trailer.WriteString("]")
+	if len(response.Fields) != 0 {
+		fields, err := json.Marshal(response.Fields)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(trailer, `,"fields":%s`, fields)
+	}
+	if response.ErrorID != "" {
+		id, _ := json.Marshal(response.ErrorID)
+		fmt.Fprintf(trailer, `,"error_id":%s`, id)
+	}
+	trailer.WriteString("}\n")
+	_, err = trailer.WriteTo(j.w)
+	return err
 }
 
 type MsgpackSerializer struct{}
@@ -94,6 +407,10 @@ func (j *MsgpackSerializer) NewDecoder(r io.Reader) ContentTypeDecoder {
 	return msgpack.NewDecoder(r)
 }
 
+// Maximum size of a single BSON request document, matching MongoDB's limit.
+// Larger documents are rejected before being read.
+var MaxBsonDocumentSize int64 = 16 << 20
+
 type BsonSerializer struct{}
 
 type bsonEncoder struct {
@@ -113,18 +430,70 @@ func (j *BsonSerializer) NewEncoder(w io.Writer) ContentTypeEncoder {
 	return &bsonEncoder{w}
 }
 
+// Decodes a stream of concatenated BSON documents, one per call to Decode.
+// Decoding into a pointer to a slice consumes the rest of the stream, with
+// each document decoded as an element.
 type bsonDecoder struct {
-	r io.Reader
+	r *bufio.Reader
 }
 
 func (b *bsonDecoder) Decode(v interface{}) error {
-	bytes, err := ioutil.ReadAll(b.r)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Slice && rv.Elem().Type().Elem().Kind() != reflect.Uint8 {
+		return b.decodeSlice(rv.Elem())
+	}
+	document, err := b.next()
 	if err != nil {
 		return err
 	}
-	return bson.Unmarshal(bytes, v)
+	return bson.Unmarshal(document, v)
+}
+
+func (b *bsonDecoder) decodeSlice(slice reflect.Value) error {
+	elements := reflect.MakeSlice(slice.Type(), 0, 0)
+	for b.more() {
+		element := reflect.New(slice.Type().Elem())
+		if err := b.Decode(element.Interface()); err != nil {
+			return err
+		}
+		elements = reflect.Append(elements, element.Elem())
+	}
+	slice.Set(elements)
+	return nil
+}
+
+// Whether the stream has any more documents. Read errors other than EOF
+// are left for the next Decode to report.
+func (b *bsonDecoder) more() bool {
+	_, err := b.r.Peek(1)
+	return err != io.EOF
+}
+
+// Read the next length-prefixed document.
+func (b *bsonDecoder) next() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(b.r, header); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	if size < 5 {
+		return nil, fmt.Errorf("invalid BSON document length %d", size)
+	}
+	if size > MaxBsonDocumentSize {
+		return nil, &http.MaxBytesError{Limit: MaxBsonDocumentSize}
+	}
+	// Grow with the data actually read rather than trusting the length
+	// prefix, so that request body limits apply before memory is allocated.
+	document := bytes.NewBuffer(header)
+	if _, err := io.CopyN(document, b.r, size-4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return document.Bytes(), nil
 }
 
 func (j *BsonSerializer) NewDecoder(r io.Reader) ContentTypeDecoder {
-	return &bsonDecoder{r}
+	return &bsonDecoder{bufio.NewReader(r)}
 }
@@ -0,0 +1,115 @@
+package webservice
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A snapshot of the service's routes, with those that can be found without
+// matching patterns indexed by "METHOD /path". A route is only indexed for a
+// method and path if no route before it would match them, so dispatching
+// from the index and continuing with the routes after it when it does not
+// handle the request behaves as though all routes were tried in order.
+type routeIndex struct {
+	routes []*Route
+	static map[string]staticRoute
+}
+
+// An indexed route with its position in routeIndex.routes.
+type staticRoute struct {
+	route *Route
+	index int
+}
+
+// The current route index, built on first use after any change to the
+// service's routes.
+func (s *Service) routeIndex() *routeIndex {
+	if index := s.index.Load(); index != nil {
+		return index
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index := s.index.Load(); index != nil {
+		return index
+	}
+	index := &routeIndex{routes: s.routes, static: map[string]staticRoute{}}
+	for i, route := range index.routes {
+		for _, path := range route.staticPaths() {
+			for _, method := range route.methods {
+				key := method + " " + path
+				if _, ok := index.static[key]; ok || matchedBefore(index.routes[:i], method, path) {
+					continue
+				}
+				index.static[key] = staticRoute{route, i}
+			}
+		}
+	}
+	s.index.Store(index)
+	return index
+}
+
+// The service's routes in matching order. Safe to use while routes are
+// added or removed.
+func (s *Service) currentRoutes() []*Route {
+	return s.routeIndex().routes
+}
+
+// Replace the service's routes with the result of update, which receives a
+// copy, and restore priority order. Requests already being routed keep
+// using the previous routes.
+func (s *Service) updateRoutes(update func(routes []*Route) []*Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := update(append([]*Route(nil), s.routes...))
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].priority > routes[j].priority
+	})
+	s.routes = routes
+	s.index.Store(nil)
+}
+
+// Whether any of routes matches method and path.
+func matchedBefore(routes []*Route, method, path string) bool {
+	for _, route := range routes {
+		// Routes with query conditions count, as they may match.
+		if len(route.matchPath(method, path)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Discard the route index after routes are changed.
+func (s *Service) invalidateRoutes() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.Store(nil)
+}
+
+func (r *Route) changed() {
+	if r.service != nil {
+		r.service.invalidateRoutes()
+	}
+}
+
+// The literal paths, including those under additional roots, that this
+// route matches, or nil if it has parameters, query conditions, matches any
+// method, or its path contains regular expression syntax.
+func (r *Route) staticPaths() []string {
+	if r.pattern == nil || len(r.params) != 0 || len(r.query) != 0 || r.anyMethod {
+		return nil
+	}
+	paths := []string{r.fullPath()}
+	if r.service != nil {
+		for _, root := range r.service.roots {
+			paths = append(paths, strings.TrimRight(root, "/")+"/"+r.path)
+		}
+	}
+	for _, path := range paths {
+		if regexp.QuoteMeta(path) != path {
+			return nil
+		}
+	}
+	return paths
+}
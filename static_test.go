@@ -0,0 +1,115 @@
+package webservice
+
+import (
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func serveTestData(s *Service, method, path string) interface{} {
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest(method, path, nil, "application/json"))
+	if writer.Code != http.StatusOK {
+		return writer.Code
+	}
+	resp := &Response{}
+	Serializers.Decode("application/json", writer.Body, resp)
+	return resp.D
+}
+
+func respondWith(v string) func(cx *Context) {
+	return func(cx *Context) { cx.RespondWithData(v) }
+}
+
+func TestStaticRoutes(t *testing.T) {
+	s := NewService("/api")
+	s.AddRoot("/v1")
+	s.Get().Path("users/{id}").ToFunction(func(cx *Context, id string) { cx.RespondWithData("user " + id) })
+	s.Get().Path("users/me").ToFunction(respondWith("shadowed"))
+	s.Get().Post().Path("status").ToFunction(respondWith("status"))
+	s.Get().Path("health").ToFunction(func(cx *Context) { cx.PassThrough() })
+	s.Get().Path("a.b").ToFunction(respondWith("dotted"))
+	s.Get().Path("{page}").ToFunction(func(cx *Context, page string) { cx.RespondWithData("page " + page) })
+
+	assert.Equal(t, serveTestData(s, "GET", "/api/status"), "status")
+	assert.Equal(t, serveTestData(s, "POST", "/api/status"), "status")
+	assert.Equal(t, serveTestData(s, "GET", "/v1/status"), "status")
+	assert.Equal(t, serveTestData(s, "GET", "/api/users/me"), "user me")
+	assert.Equal(t, serveTestData(s, "GET", "/api/health"), "page health")
+	// Literal matching must not change how regexp syntax in paths behaves.
+	assert.Equal(t, serveTestData(s, "GET", "/api/aXb"), "dotted")
+	_, indexed := s.routeIndex().static["GET /api/users/me"]
+	assert.False(t, indexed)
+
+	// Changes to routes are reflected after the index has been built.
+	s.Get().Path("status").Priority(1).ToFunction(respondWith("new status"))
+	assert.Equal(t, serveTestData(s, "GET", "/api/status"), "new status")
+	assert.Equal(t, serveTestData(s, "POST", "/api/status"), "status")
+}
+
+func TestAddRemoveRoute(t *testing.T) {
+	s := NewService("/api")
+	s.Get().Path("status").ToFunction(respondWith("status"))
+
+	s.AddRoute(NewRoute().Get().Path("extra").Named("extra").ToFunction(respondWith("extra")))
+	assert.Equal(t, serveTestData(s, "GET", "/api/extra"), "extra")
+	assert.True(t, s.RemoveRoute("extra"))
+	assert.Equal(t, serveTestData(s, "GET", "/api/extra"), http.StatusNotFound)
+	assert.False(t, s.RemoveRoute("extra"))
+
+	// Routes can be changed while requests are being served.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if serveTestData(s, "GET", "/api/status") != "status" {
+					t.Error("status route not served")
+					return
+				}
+				serveTestData(s, "GET", "/api/extra")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		s.AddRoute(NewRoute().Get().Path("extra").Named("extra").ToFunction(respondWith("extra")))
+		s.RemoveRoute("extra")
+	}
+	close(done)
+	wg.Wait()
+}
+
+func benchmarkService(routes int) *Service {
+	s := NewService("/")
+	for i := 0; i < routes; i++ {
+		s.Get().Path(fmt.Sprintf("things%d/{id}", i)).ToFunction(func(cx *Context, id int) {})
+		s.Get().Path(fmt.Sprintf("static%d", i)).ToFunction(func(cx *Context) {})
+	}
+	return s
+}
+
+func BenchmarkStaticRoute(b *testing.B) {
+	s := benchmarkService(100)
+	req := newTestRequest("GET", "/static99", nil, "application/json")
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkParameterizedRoute(b *testing.B) {
+	s := benchmarkService(100)
+	req := newTestRequest("GET", "/things99/1", nil, "application/json")
+	for i := 0; i < b.N; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
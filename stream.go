@@ -0,0 +1,93 @@
+package webservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+var StreamElementNotDecoded = errors.New("stream element was not decoded")
+
+// Decode a request body containing an array one element at a time, so that
+// large arrays are never held in memory. fn is called once per element and
+// must call decode exactly once to consume it, or DecodeStream returns
+// StreamElementNotDecoded.
+//
+// JSON request bodies must contain an array. BSON request bodies are a
+// stream of concatenated documents, each of which is an element.
+func (c *Context) DecodeStream(fn func(decode func(v interface{}) error) error) error {
+	ct, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+	case "application/bson":
+		decoder := &bsonDecoder{bufio.NewReader(c.Request.Body)}
+		for decoder.more() {
+			if err := decodeElement(fn, decoder.Decode); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return UnsupportedContentType
+	}
+	decoder := json.NewDecoder(c.Request.Body)
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for decoder.More() {
+		if err := decodeElement(fn, decoder.Decode); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+// Call fn with decode, failing if it does not consume the element.
+func decodeElement(fn func(decode func(v interface{}) error) error, decode func(v interface{}) error) error {
+	decoded := false
+	err := fn(func(v interface{}) error {
+		decoded = true
+		return decode(v)
+	})
+	if err == nil && !decoded {
+		return StreamElementNotDecoded
+	}
+	return err
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q in JSON stream but got %v", delim, token)
+	}
+	return nil
+}
+
+// Copy r to the response without serialization, closing it afterwards if it
+// is an io.Closer. If r is an io.ReadSeeker and status is 200, range requests
+// are supported.
+func (c *Context) RespondWithReader(status int, contentType string, r io.Reader) error {
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
+	c.ResponseWriter.Header().Set("Content-Type", contentType)
+	if seeker, ok := r.(io.ReadSeeker); ok && status == http.StatusOK {
+		http.ServeContent(c.ResponseWriter, c.Request, "", time.Time{}, seeker)
+		return nil
+	}
+	c.ResponseWriter.WriteHeader(status)
+	_, err = io.Copy(c.ResponseWriter, r)
+	return err
+}
@@ -0,0 +1,52 @@
+package webservice
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The syntax of path parameters in routes added to a service.
+type PathSyntax int
+
+const (
+	// Parameters are enclosed in braces: /users/{id}, /files/{path...}. The
+	// default.
+	BraceSyntax PathSyntax = iota
+	// Parameters are prefixed with a colon and catch-alls with an asterisk:
+	// /users/:id, /files/*path.
+	ColonSyntax
+	// Unnamed wildcards: * matches a segment and ** the rest of the path, as
+	// in /users/*/files/**. Parameters are named by position, from "0".
+	AsteriskSyntax
+)
+
+// Use syntax for path parameters in routes added after this call. Paths in
+// any syntax are translated to the brace form, which remains accepted, so
+// they match, capture and reverse identically.
+func (s *Service) Syntax(syntax PathSyntax) {
+	s.pathSyntax = syntax
+}
+
+// Translate path to brace syntax.
+func (syntax PathSyntax) translate(path string) string {
+	if syntax == BraceSyntax {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	index := 0
+	for i, segment := range segments {
+		switch {
+		case syntax == ColonSyntax && len(segment) > 1 && segment[0] == ':':
+			segments[i] = "{" + segment[1:] + "}"
+		case syntax == ColonSyntax && len(segment) > 1 && segment[0] == '*':
+			segments[i] = "{" + segment[1:] + "...}"
+		case syntax == AsteriskSyntax && segment == "*":
+			segments[i] = "{" + strconv.Itoa(index) + "}"
+			index++
+		case syntax == AsteriskSyntax && segment == "**":
+			segments[i] = "{" + strconv.Itoa(index) + "...}"
+			index++
+		}
+	}
+	return strings.Join(segments, "/")
+}
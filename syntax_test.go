@@ -0,0 +1,47 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+)
+
+func TestColonSyntax(t *testing.T) {
+	brace := NewService("/")
+	brace.Get().Path("/users/{id}").ToFunction(func(cx *Context, id string) {})
+	brace.Get().Path("/files/{path...}").ToFunction(func(cx *Context, path string) {})
+	colon := NewService("/")
+	colon.Syntax(ColonSyntax)
+	colon.Get().Path("/users/:id").ToFunction(func(cx *Context, id string) {})
+	colon.Get().Path("/files/*path").ToFunction(func(cx *Context, path string) {})
+
+	for _, path := range []string{"/users/42", "/users/42/extra", "/files/a/b.txt", "/files/", "/other"} {
+		braceRoute, braceArgs, braceOK := brace.Match("GET", path)
+		colonRoute, colonArgs, colonOK := colon.Match("GET", path)
+		assert.Equal(t, colonOK, braceOK, path)
+		assert.Equal(t, colonArgs, braceArgs, path)
+		if braceOK {
+			assert.Equal(t, colonRoute.fullPath(), braceRoute.fullPath(), path)
+		}
+	}
+	route, args, _ := colon.Match("GET", "/users/42")
+	assert.Equal(t, args, map[string]string{"id": "42"})
+	assert.Equal(t, route.Reverse(Args{"id": "7"}), "/users/7")
+}
+
+func TestAsteriskSyntax(t *testing.T) {
+	s := NewService("/")
+	s.Syntax(AsteriskSyntax)
+	s.Get().Path("/users/*/files/**").ToFunction(func(cx *Context, user, path string) {})
+	_, args, ok := s.Match("GET", "/users/alice/files/a/b.txt")
+	assert.True(t, ok)
+	assert.Equal(t, args, map[string]string{"0": "alice", "1": "a/b.txt"})
+}
+
+func TestSyntaxAddRoute(t *testing.T) {
+	s := NewService("/api")
+	s.Syntax(ColonSyntax)
+	s.AddRoute(NewRoute().Get().Path("/users/:id").ToFunction(func(cx *Context, id string) {}))
+	_, args, ok := s.Match("GET", "/api/users/42")
+	assert.True(t, ok)
+	assert.Equal(t, args, map[string]string{"id": "42"})
+}
@@ -0,0 +1,23 @@
+package webservice
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// Execute the named template with data and respond with the result as
+// text/html. Output is buffered, so a failing template results in a plain
+// text 500 rather than a partial page. The template error is returned.
+func (c *Context) RespondWithTemplate(status int, tmpl *template.Template, name string, data interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := tmpl.ExecuteTemplate(buf, name, data); err != nil {
+		// Browsers ask for HTML, which has no envelope serializer.
+		if _, claimErr := c.claimResponse(http.StatusInternalServerError); claimErr != nil {
+			return claimErr
+		}
+		writePlainTextError(c.ResponseWriter, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return err
+	}
+	return c.RespondRaw(status, "text/html; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,34 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondWithTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("page").Parse(`<h1>{{.}}</h1>`))
+	template.Must(tmpl.New("broken").Parse(`<h1>{{.Missing}}</h1>`))
+	s := NewService("/")
+	s.Get().Path("page/{name}").ToFunction(func(cx *Context, name string) {
+		cx.RespondWithTemplate(http.StatusOK, tmpl, name, "<Hello>")
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/page/page", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Equal(t, writer.Body.String(), "<h1>&lt;Hello&gt;</h1>")
+
+	for _, accept := range []string{"application/json", "text/html", ""} {
+		req := newTestRequest("GET", "/page/broken", nil, "")
+		req.Header.Set("Accept", accept)
+		writer = httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusInternalServerError, accept)
+		assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8", accept)
+		assert.Equal(t, writer.Body.String(), "Internal Server Error\n", accept)
+	}
+}
@@ -0,0 +1,176 @@
+package webservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Variants are registered per interface type, so the same discriminator
+// value can name different types for different fields.
+type variantKey struct {
+	iface reflect.Type
+	name  string
+}
+
+var (
+	variantsLock sync.RWMutex
+	variants     = map[variantKey]reflect.Type{}
+)
+
+// Register the type of prototype as the variant of interface I decoded from
+// JSON for the discriminator value name. Fields of type I in request structs
+// tagged with the key of their discriminator, eg.
+//
+//	RegisterVariant[Payload]("click", &ClickPayload{})
+//
+//	type Event struct {
+//		Type    string  `json:"type"`
+//		Payload Payload `json:"payload" variant:"type"`
+//	}
+//
+// are decoded as the variant registered for the discriminator's value, in a
+// second pass over the body. Only fields of the top-level struct are
+// resolved. An unregistered value is reported as a *DecodeError. Panics if I
+// is not an interface type or prototype is nil.
+func RegisterVariant[I any](name string, prototype I) {
+	iface := reflect.TypeOf((*I)(nil)).Elem()
+	if iface.Kind() != reflect.Interface {
+		panic(fmt.Sprintf("variant %q registered for %s, which is not an interface", name, iface))
+	}
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		panic(fmt.Sprintf("variant %q of %s has a nil prototype", name, iface))
+	}
+	variantsLock.Lock()
+	defer variantsLock.Unlock()
+	variants[variantKey{iface, name}] = t
+}
+
+// Decodes JSON, resolving variant fields of structs.
+type jsonDecoder struct {
+	*json.Decoder
+	disallowUnknownFields bool
+}
+
+func (j *jsonDecoder) Decode(v interface{}) error {
+	if !hasVariantFields(v) {
+		return j.Decoder.Decode(v)
+	}
+	raw := json.RawMessage{}
+	if err := j.Decoder.Decode(&raw); err != nil {
+		return err
+	}
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &object); err != nil || object == nil {
+		return j.unmarshal(raw, v)
+	}
+	// Decode everything else first, as variant fields can not be decoded
+	// until their discriminator is known.
+	rv := reflect.ValueOf(v).Elem()
+	rest := map[string]json.RawMessage{}
+	for key, value := range object {
+		rest[key] = value
+	}
+	for _, field := range variantFields(rv.Type()) {
+		for key := range rest {
+			if strings.EqualFold(key, jsonKey(field)) {
+				delete(rest, key)
+			}
+		}
+	}
+	data, err := json.Marshal(rest)
+	if err != nil {
+		return err
+	}
+	if err := j.unmarshal(data, v); err != nil {
+		return err
+	}
+	return j.resolveVariants(object, rv)
+}
+
+func (j *jsonDecoder) unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if j.disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
+
+// Decode each variant field of rv, a struct, from its value in object.
+func (j *jsonDecoder) resolveVariants(object map[string]json.RawMessage, rv reflect.Value) error {
+	decodeErr := &DecodeError{}
+	for _, field := range variantFields(rv.Type()) {
+		key := jsonKey(field)
+		value, ok := lookupRaw(object, key)
+		if !ok || string(value) == "null" {
+			continue
+		}
+		discriminator := field.Tag.Get("variant")
+		var name string
+		if raw, ok := lookupRaw(object, discriminator); !ok || json.Unmarshal(raw, &name) != nil {
+			decodeErr.Add(discriminator, "expected a variant name")
+			continue
+		}
+		variantsLock.RLock()
+		t, ok := variants[variantKey{field.Type, name}]
+		variantsLock.RUnlock()
+		if !ok {
+			decodeErr.Add(discriminator, fmt.Sprintf("unknown variant %q", name))
+			continue
+		}
+		variant := reflect.New(t)
+		if err := j.unmarshal(value, variant.Interface()); err != nil {
+			decodeErr.merge(key+".", asDecodeError(err))
+			continue
+		}
+		rv.FieldByIndex(field.Index).Set(variant.Elem())
+	}
+	if len(decodeErr.Fields) != 0 {
+		return decodeErr
+	}
+	return nil
+}
+
+// The exported interface-typed fields of t, a struct, tagged as variants.
+func variantFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath == "" && field.Type.Kind() == reflect.Interface && field.Tag.Get("variant") != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// The JSON object key of field.
+func jsonKey(field reflect.StructField) string {
+	if key, _ := parseTag(field.Tag.Get("json")); key != "" {
+		return key
+	}
+	return field.Name
+}
+
+// Whether v points to a struct with variant fields.
+func hasVariantFields(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct && len(variantFields(t.Elem())) != 0
+}
+
+// Look up key in object, falling back to a case-insensitive match as
+// encoding/json does.
+func lookupRaw(object map[string]json.RawMessage, key string) (json.RawMessage, bool) {
+	if value, ok := object[key]; ok {
+		return value, true
+	}
+	for k, value := range object {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+	return nil, false
+}
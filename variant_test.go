@@ -0,0 +1,103 @@
+package webservice
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type eventPayload interface {
+	describe() string
+}
+
+type clickEvent struct {
+	X, Y int
+}
+
+func (c *clickEvent) describe() string { return "click" }
+
+type keyEvent struct {
+	Key string `json:"key"`
+}
+
+func (k keyEvent) describe() string { return "key " + k.Key }
+
+type testPayload interface {
+	size() int
+}
+
+type keyPayload struct {
+	Bytes []byte `json:"bytes"`
+}
+
+func (k *keyPayload) size() int { return len(k.Bytes) }
+
+type testEvent struct {
+	Type    string       `json:"type"`
+	Payload eventPayload `json:"payload" variant:"type"`
+}
+
+func TestDecodeVariants(t *testing.T) {
+	RegisterVariant[eventPayload]("click", &clickEvent{})
+	RegisterVariant[eventPayload]("key", keyEvent{})
+	defer func() {
+		variantsLock.Lock()
+		delete(variants, variantKey{reflect.TypeOf((*eventPayload)(nil)).Elem(), "click"})
+		delete(variants, variantKey{reflect.TypeOf((*eventPayload)(nil)).Elem(), "key"})
+		variantsLock.Unlock()
+	}()
+	var event *testEvent
+	s := NewService("/")
+	s.Post().Path("events").DecodeRequest(&testEvent{}).ToFunction(func(cx *Context, req *testEvent) {
+		event = req
+		cx.RespondWithData(req.Payload.describe())
+	})
+
+	for _, test := range []struct {
+		body    string
+		payload eventPayload
+	}{
+		{`{"type": "click", "payload": {"X": 1, "Y": 2}}`, &clickEvent{1, 2}},
+		{`{"payload": {"key": "q"}, "type": "key"}`, keyEvent{"q"}},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("POST", "/events", strings.NewReader(test.body), "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK, test.body)
+		assert.Equal(t, event.Payload, test.payload)
+		assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, test.payload.describe())
+	}
+
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"type": "scroll", "payload": {}}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/events", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.Fields, []FieldError{{Field: "type", Message: `unknown variant "scroll"`}})
+}
+
+func TestVariantsArePerInterface(t *testing.T) {
+	RegisterVariant[eventPayload]("key", keyEvent{})
+	RegisterVariant[testPayload]("key", &keyPayload{})
+	defer func() {
+		variantsLock.Lock()
+		delete(variants, variantKey{reflect.TypeOf((*eventPayload)(nil)).Elem(), "key"})
+		delete(variants, variantKey{reflect.TypeOf((*testPayload)(nil)).Elem(), "key"})
+		variantsLock.Unlock()
+	}()
+	type message struct {
+		Kind    string       `json:"kind"`
+		Event   eventPayload `json:"event" variant:"kind"`
+		Payload testPayload  `json:"payload" variant:"kind"`
+	}
+	v := &message{}
+	body := `{"kind": "key", "event": {"key": "q"}, "payload": {"bytes": "AQI="}}`
+	assert.NoError(t, Serializers.Decode("application/json", strings.NewReader(body), v))
+	assert.Equal(t, v.Event, keyEvent{"q"})
+	assert.Equal(t, v.Payload, &keyPayload{[]byte{1, 2}})
+
+	assert.Panics(t, func() { RegisterVariant("click", &clickEvent{}) })
+	assert.Panics(t, func() { RegisterVariant[eventPayload]("none", nil) })
+}
@@ -1,26 +1,55 @@
 package webservice
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	pathTransform = regexp.MustCompile(`{((\w+)(\.\.\.)?)}`)
+	pathTransform = regexp.MustCompile(`{((\w+)(\.\.\.)?(\?)?)}`)
+	// Optional parameters not substituted by Reverse, with their slash.
+	// Optional catch-alls keep the slash, as they match an empty remainder.
+	optionalPlaceholder = regexp.MustCompile(`/?{\w+\?}|{\w+\.\.\.\?}`)
+	AlreadyResponded    = errors.New("response already written")
+	// Maximum number of parameters in a route path. Registering a route
+	// with more panics.
+	MaxRouteParams = 16
+	// Short format names usable with Service.FormatQueryParam.
+	FormatTokens = map[string]string{
+		"json":    "application/json",
+		"msgpack": "application/x-msgpack",
+		"bson":    "application/bson",
+	}
 )
 
 type Dispatcher func(cx *Context, req interface{}) bool
+
+// Middleware wraps dispatch of a route. It either calls next and returns its
+// result, or handles the request itself and returns true.
+type Middleware func(cx *Context, next func() bool) bool
+
 type Args map[string]string
 
 type Response struct {
 	S int
 	E interface{} // always a string, but an interface{} here so it can be nil
 	D interface{}
+	// Per-field details for request decoding and validation errors.
+	Fields []FieldError `json:"fields,omitempty" msgpack:"fields,omitempty" bson:"fields,omitempty"`
+	// Identifies the logged details of an internal error.
+	ErrorID string `json:"error_id,omitempty" msgpack:"error_id,omitempty" bson:"error_id,omitempty"`
 }
 
 func FunctionDispatcher(function reflect.Value) Dispatcher {
@@ -30,17 +59,48 @@ func FunctionDispatcher(function reflect.Value) Dispatcher {
 		if req != nil {
 			shift++
 		}
-		if functype.NumIn() != shift+len(cx.Args) {
+		args := cx.Args
+		variadic := functype.IsVariadic()
+		if variadic {
+			args = cx.expandCatchAll()
+		}
+		if (variadic && shift+len(args) < functype.NumIn()-1) || (!variadic && functype.NumIn() != shift+len(args)) {
+			cx.logf("invalid number of arguments for %s handler of %s %s: %d", functype, cx.Request.Method, cx.Request.URL, shift+len(args))
 			cx.Respond(http.StatusInternalServerError, "invalid number of arguments", nil)
 			return true
 		}
-		in := make([]reflect.Value, shift, shift+len(cx.Args))
+		in := make([]reflect.Value, shift, shift+len(args))
 		in[0] = reflect.ValueOf(cx)
 		if req != nil {
 			in[1] = reflect.ValueOf(req)
+			// Allow eg. func(cx, map[string]interface{}) for a *map request.
+			if in[1].Type() != functype.In(1) && in[1].Elem().Type() == functype.In(1) {
+				in[1] = in[1].Elem()
+			}
 		}
-		for i, s := range cx.Args {
-			v, err := coerce(s, functype.In(i+shift))
+		for i, s := range args {
+			var t reflect.Type
+			if variadic && i+shift >= functype.NumIn()-1 {
+				t = functype.In(functype.NumIn() - 1).Elem()
+			} else {
+				t = functype.In(i + shift)
+			}
+			if convert := cx.converter(i); convert != nil {
+				cv, err := convert(s)
+				if err != nil {
+					cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+					return true
+				}
+				v := reflect.ValueOf(cv)
+				if !v.IsValid() || !v.Type().ConvertibleTo(t) {
+					cx.logf("converter for %s %s returned %T, expected %s", cx.Request.Method, cx.Request.URL, cv, t)
+					cx.Respond(http.StatusInternalServerError, fmt.Sprintf("converter returned %T, expected %s", cv, t), nil)
+					return true
+				}
+				in = append(in, v.Convert(t))
+				continue
+			}
+			v, err := coerce(s, t)
 			if err != nil {
 				return false
 			}
@@ -53,16 +113,35 @@ func FunctionDispatcher(function reflect.Value) Dispatcher {
 
 // Routes are specified like so:
 //      /some/path/{arg0}/{arg1}
-// arg0 and arg1 are mapped to handler method arguments.
+// arg0 and arg1 are mapped to handler method arguments. {arg...} matches the
+// remainder of the path, {arg...?} a possibly empty remainder, and {arg?} an
+// optional segment.
 type Route struct {
-	prefix  string
-	path    string
-	name    string
-	pattern *regexp.Regexp
-	methods []string
-	params  []string
-	handler Dispatcher
-	request reflect.Type
+	prefix     string
+	path       string
+	name       string
+	pattern    *regexp.Regexp
+	aliases    []*regexp.Regexp
+	methods    []string
+	anyMethod  bool
+	params     []string
+	catchAll   bool
+	defaults   map[string]string
+	handler    Dispatcher
+	request    reflect.Type
+	service    *Service
+	middleware []Middleware
+	converters map[string]func(string) (interface{}, error)
+	priority   int
+	maxBody    int64
+	noCompress bool
+	headers    http.Header
+	argsHooks  []func(args []string) ([]string, error)
+	query      url.Values
+	onPanic    func(cx *Context, recovered interface{})
+
+	keepExtension  bool
+	beforeDispatch []func(cx *Context, req interface{}) error
 }
 
 func NewRoute() *Route {
@@ -77,12 +156,22 @@ func (r *Route) String() string {
 	return fmt.Sprintf("Route{name: %v, pattern: %s, methods: %v}", r.name, r.pattern, r.methods)
 }
 
+// Substitute args into the route path. Values are path escaped, except that
+// slashes in catch-all ({arg...}) values are preserved. Optional ({arg?})
+// parameters missing from args are omitted.
 func (r *Route) Reverse(args Args) string {
 	path := r.fullPath()
 	for arg, value := range args {
-		path = strings.Replace(path, "{"+arg+"}", value, 1)
+		path = strings.Replace(path, "{"+arg+"}", url.PathEscape(value), 1)
+		path = strings.Replace(path, "{"+arg+"?}", url.PathEscape(value), 1)
+		segments := strings.Split(value, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		path = strings.Replace(path, "{"+arg+"...}", strings.Join(segments, "/"), 1)
+		path = strings.Replace(path, "{"+arg+"...?}", strings.Join(segments, "/"), 1)
 	}
-	return path
+	return optionalPlaceholder.ReplaceAllString(path, "")
 }
 
 func (r *Route) Method() string {
@@ -92,13 +181,15 @@ func (r *Route) Method() string {
 	return r.methods[0]
 }
 
-// Automatically decode the request body into a value of type req. Functions
-// and methods will then be called with the signature
-// f(*Context, TypeOf(req), ...)
+// Automatically decode the request body into a value of type req, which must
+// be a pointer to a struct, map or slice. Functions and methods will then be
+// called with the signature f(*Context, TypeOf(req), ...). Maps and slices may
+// also be received by value. Struct fields tagged `header:"..."` are
+// populated from the request headers.
 func (r *Route) DecodeRequest(req interface{}) *Route {
 	r.request = reflect.TypeOf(req)
-	if r.request.Kind() != reflect.Ptr {
-		panic("request structure must be a pointer")
+	if r.request == nil || r.request.Kind() != reflect.Ptr {
+		panic("request must be a pointer")
 	}
 	return r
 }
@@ -108,6 +199,14 @@ func (r *Route) Prefix(path string) *Route {
 	return r.compilePath()
 }
 
+// Match this route against the full request path, even if the service's
+// ExtensionNegotiation would strip a format extension from it, eg. for
+// routes serving files.
+func (r *Route) KeepExtension() *Route {
+	r.keepExtension = true
+	return r
+}
+
 func (r *Route) Named(name string) *Route {
 	r.name = name
 	return r
@@ -152,53 +251,282 @@ func (r *Route) ToMethod(v interface{}, method string) *Route {
 }
 
 func (r *Route) Path(path string) *Route {
+	if r.service != nil {
+		path = r.service.pathSyntax.translate(path)
+	}
 	r.path = strings.TrimLeft(path, "/")
 	return r.compilePath()
 }
 
 func (r *Route) compilePath() *Route {
-	routePattern := "^" + r.fullPath() + "$"
-	for _, match := range pathTransform.FindAllStringSubmatch(routePattern, 16) {
+	r.pattern, r.params, r.catchAll = compileRoutePath(r.fullPath())
+	r.aliases = nil
+	if r.service != nil {
+		for _, root := range r.service.roots {
+			alias, _, _ := compileRoutePath(strings.TrimRight(root, "/") + "/" + r.path)
+			r.aliases = append(r.aliases, alias)
+		}
+	}
+	r.changed()
+	return r
+}
+
+// Compile a route path into a pattern, returning it along with the parameter
+// names and whether the last is a catch-all. Panics if the path has more
+// than MaxRouteParams parameters.
+func compileRoutePath(path string) (*regexp.Regexp, []string, bool) {
+	routePattern := "^" + path + "$"
+	params := []string{}
+	catchAll := false
+	matches := pathTransform.FindAllStringSubmatch(routePattern, -1)
+	if len(matches) > MaxRouteParams {
+		panic(fmt.Sprintf("route %q has %d parameters, more than MaxRouteParams (%d)", path, len(matches), MaxRouteParams))
+	}
+	for _, match := range matches {
+		placeholder := match[0]
 		pattern := `([^/]+)`
 		if match[3] == "..." {
 			pattern = `(.+)`
+			if match[4] == "?" {
+				pattern = `(.*)`
+			}
+			catchAll = true
+		} else if match[4] == "?" {
+			pattern = `([^/]*)`
+			// Make the preceding slash optional too, so /a/{b?} matches /a.
+			if strings.Contains(routePattern, "/"+placeholder) {
+				placeholder = "/" + placeholder
+				pattern = `(?:/([^/]*))?`
+			}
 		}
-		routePattern = strings.Replace(routePattern, match[0], pattern, 1)
+		routePattern = strings.Replace(routePattern, placeholder, pattern, 1)
+		params = append(params, match[2])
 	}
 	pattern, _ := regexp.Compile(routePattern)
-	r.pattern = pattern
-	r.params = []string{}
-	for _, arg := range pathTransform.FindAllString(r.prefix+r.path, 16) {
-		r.params = append(r.params, arg[1:len(arg)-1])
-	}
-	return r
+	return pattern, params, catchAll
 }
 
 func (r *Route) Get() *Route {
 	r.methods = append(r.methods, "GET")
+	r.changed()
 	return r
 }
 
 func (r *Route) Delete() *Route {
 	r.methods = append(r.methods, "DELETE")
+	r.changed()
 	return r
 }
 
 func (r *Route) Put() *Route {
 	r.methods = append(r.methods, "PUT")
+	r.changed()
 	return r
 }
 
 func (r *Route) Post() *Route {
 	r.methods = append(r.methods, "POST")
+	r.changed()
+	return r
+}
+
+// Call hook with the decoded request (or nil) before dispatching to the
+// handler. If hook returns an error the handler is not called, and the
+// client receives 422 Unprocessable Entity for a *DecodeError or 400 Bad
+// Request otherwise.
+func (r *Route) BeforeDispatch(hook func(cx *Context, req interface{}) error) *Route {
+	r.beforeDispatch = append(r.beforeDispatch, hook)
+	return r
+}
+
+// Add middleware around dispatch of this route. Middleware runs in the order
+// added, before the request is decoded.
+func (r *Route) Use(middleware ...Middleware) *Route {
+	r.middleware = append(r.middleware, middleware...)
+	return r
+}
+
+// Transform or validate the route's path arguments, after defaults are
+// applied and before they are coerced for the handler. An error responds
+// with 400 Bad Request.
+func (r *Route) ArgsHook(hook func(args []string) ([]string, error)) *Route {
+	r.argsHooks = append(r.argsHooks, hook)
+	return r
+}
+
+// Only match requests whose query parameter name equals value, or, if value
+// is empty, is present.
+func (r *Route) Query(name, value string) *Route {
+	if r.query == nil {
+		r.query = url.Values{}
+	}
+	r.query.Add(name, value)
+	r.changed()
+	return r
+}
+
+// Handle panics from this route's middleware and handler with handler,
+// instead of responding with an internal error.
+func (r *Route) OnPanic(handler func(cx *Context, recovered interface{})) *Route {
+	r.onPanic = handler
+	return r
+}
+
+// Add a header to every response from this route, eg. Cache-Control.
+func (r *Route) SetHeader(key, value string) *Route {
+	if r.headers == nil {
+		r.headers = http.Header{}
+	}
+	r.headers.Add(key, value)
+	return r
+}
+
+// Never compress responses from this route, eg. for already compressed
+// content or event streams.
+func (r *Route) DisableCompression() *Route {
+	r.noCompress = true
+	return r
+}
+
+// Limit request bodies for this route to n bytes, overriding the service's
+// MaxBodyBytes. -1 means unlimited.
+func (r *Route) MaxBody(n int64) *Route {
+	r.maxBody = n
+	return r
+}
+
+// The effective request body limit for the route, or 0 if unlimited.
+func (r *Route) bodyLimit() int64 {
+	switch {
+	case r.maxBody < 0:
+		return 0
+	case r.maxBody > 0:
+		return r.maxBody
+	case r.service != nil:
+		return r.service.MaxBodyBytes
+	}
+	return 0
+}
+
+// Set the route's priority. Routes are matched in descending priority order,
+// and in registration order within the same priority. The default is 0.
+func (r *Route) Priority(n int) *Route {
+	r.priority = n
+	if r.service != nil {
+		r.service.sortRoutes()
+	}
+	return r
+}
+
+// Use value for the named parameter when it is empty or, for an optional
+// ({param?}) segment, absent.
+func (r *Route) Default(param, value string) *Route {
+	if r.defaults == nil {
+		r.defaults = map[string]string{}
+	}
+	r.defaults[param] = value
+	return r
+}
+
+// Convert the named parameter with fn instead of the built-in coercion. If
+// fn returns an error the request is rejected with 400 Bad Request.
+func (r *Route) Convert(param string, fn func(string) (interface{}, error)) *Route {
+	if r.converters == nil {
+		r.converters = map[string]func(string) (interface{}, error){}
+	}
+	r.converters[param] = fn
+	return r
+}
+
+// Match any request method. This is also the behaviour of a route with no
+// methods declared, but makes the intent explicit.
+func (r *Route) Any() *Route {
+	r.anyMethod = true
+	r.changed()
 	return r
 }
 
 func (r *Route) match(req *http.Request) []string {
-	if len(r.methods) != 0 {
+	if !r.matchQuery(req.URL.Query()) {
+		return nil
+	}
+	return r.matchPath(req.Method, requestPath(req))
+}
+
+// Whether query satisfies the route's Query conditions.
+func (r *Route) matchQuery(query url.Values) bool {
+	for name, values := range r.query {
+		for _, value := range values {
+			if _, ok := query[name]; !ok || (value != "" && query.Get(name) != value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The compiled pattern matched against request paths, or nil if the route
+// has no path. Paths served through Service.AddRoot roots are matched by
+// separate patterns.
+func (r *Route) Pattern() *regexp.Regexp {
+	return r.pattern
+}
+
+// The submatches of the route pattern against req, as used for dispatch:
+// the whole path followed by one group per parameter. Returns nil if the
+// route does not match req, including its method.
+func (r *Route) MatchGroups(req *http.Request) []string {
+	return r.match(req)
+}
+
+// The raw request path, excluding any query string.
+func requestPath(req *http.Request) string {
+	path := req.RequestURI
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+type extensionKey struct{}
+
+// Split a FormatTokens extension from the last segment of path, returning
+// the path without it and the extension's content type.
+func splitExtension(path string) (string, string, bool) {
+	dot := strings.LastIndexByte(path, '.')
+	if dot < strings.LastIndexByte(path, '/') {
+		return path, "", false
+	}
+	ct, ok := FormatTokens[path[dot+1:]]
+	if !ok {
+		return path, "", false
+	}
+	return path[:dot], ct, true
+}
+
+// Remove a FormatTokens extension from the last segment of the request path,
+// recording its content type in the request context.
+func stripExtension(req *http.Request) *http.Request {
+	path := requestPath(req)
+	stripped, ct, ok := splitExtension(path)
+	if !ok {
+		return req
+	}
+	extension := path[len(stripped):]
+	req = req.WithContext(context.WithValue(req.Context(), extensionKey{}, ct))
+	req.RequestURI = stripped + req.RequestURI[len(path):]
+	u := *req.URL
+	u.Path = strings.TrimSuffix(u.Path, extension)
+	u.RawPath = strings.TrimSuffix(u.RawPath, extension)
+	req.URL = &u
+	return req
+}
+
+func (r *Route) matchPath(method, path string) []string {
+	if !r.anyMethod && len(r.methods) != 0 {
 		matchedMethod := false
 		for _, m := range r.methods {
-			if m == req.Method {
+			if m == method {
 				matchedMethod = true
 				break
 			}
@@ -207,66 +535,399 @@ func (r *Route) match(req *http.Request) []string {
 			return nil
 		}
 	}
+	return r.matchPattern(path)
+}
+
+// Match path against the route pattern and aliases, regardless of method.
+func (r *Route) matchPattern(path string) []string {
 	if r.pattern == nil {
-		return []string{req.RequestURI}
+		return []string{path}
+	}
+	if args := r.pattern.FindStringSubmatch(path); args != nil {
+		return args
+	}
+	for _, alias := range r.aliases {
+		if args := alias.FindStringSubmatch(path); args != nil {
+			return args
+		}
+	}
+	return nil
+}
+
+// Map parameter names to their values in args, as returned by match.
+func (r *Route) paramMap(args []string) map[string]string {
+	params := map[string]string{}
+	for i, param := range r.params {
+		if i+1 < len(args) {
+			params[param] = args[i+1]
+		}
 	}
-	return r.pattern.FindStringSubmatch(req.RequestURI)
+	return params
 }
 
 func (r *Route) fullPath() string {
 	return r.prefix + r.path
 }
 
-func (r *Route) apply(args []string, writer http.ResponseWriter, req *http.Request) bool {
-	cx := &Context{args[1:], writer, req}
-	defer cx.Request.Body.Close()
+func (r *Route) apply(args []string, writer http.ResponseWriter, req *http.Request) (handled bool) {
+	recorder := &responseRecorder{ResponseWriter: writer}
+	writer = recorder
+	if r.service != nil && r.service.Compress && !r.noCompress {
+		if encoding := chooseEncoding(req.Header.Get("Accept-Encoding")); encoding != "" {
+			compressor := newCompressWriter(writer, encoding)
+			defer compressor.Close()
+			writer = compressor
+		}
+	}
+	args = args[1:]
+	for i, param := range r.params {
+		if i < len(args) && args[i] == "" {
+			if value, ok := r.defaults[param]; ok {
+				args[i] = value
+			}
+		}
+	}
+	for key, values := range r.headers {
+		for _, value := range values {
+			writer.Header().Add(key, value)
+		}
+	}
+	cx := &Context{Args: args, ResponseWriter: writer, Request: req, service: r.service, route: r, recorder: recorder}
+	defer func() {
+		if recorder.err != nil {
+			cx.writeError(recorder.err)
+		}
+		if handled && r.service != nil && r.service.OnError != nil && recorder.status >= 400 {
+			r.service.OnError(cx, recorder.status)
+		}
+	}()
+	// Decompress before limiting, so the limit applies to what handlers and
+	// serializers actually read.
+	if err := decodeContentEncoding(req); err != nil {
+		status := http.StatusBadRequest
+		if err == UnsupportedContentEncoding {
+			status = http.StatusUnsupportedMediaType
+		}
+		req.Body.Close()
+		cx.RespondWithError(status, err)
+		return true
+	}
+	if limit := r.bodyLimit(); limit > 0 {
+		req.Body = http.MaxBytesReader(writer, req.Body, limit)
+	}
+	defer func() {
+		// Leave the body open for the next route when passing through.
+		if handled {
+			cx.Request.Body.Close()
+		}
+	}()
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			if r.onPanic != nil {
+				r.onPanic(cx, v)
+			} else {
+				cx.InternalError(fmt.Errorf("panic: %v", v))
+			}
+			handled = true
+		}
+	}()
+	for _, hook := range r.argsHooks {
+		hooked, err := hook(cx.Args)
+		if err != nil {
+			cx.RespondWithError(http.StatusBadRequest, err)
+			return true
+		}
+		cx.Args = hooked
+	}
+	handled = r.next(cx, 0) && !cx.passThrough
+	// Send a status recorded with SetStatus, or a conventional one, if the
+	// handler wrote nothing.
+	if handled && !cx.responded && recorder.status == 0 {
+		if status := cx.conventionalStatus(false); status != http.StatusOK || cx.status != 0 {
+			cx.WriteStatus(status)
+		}
+	}
+	return handled
+}
+
+// Run the route middleware from index i onwards, then dispatch. Nothing
+// further runs once the context is aborted.
+func (r *Route) next(cx *Context, i int) bool {
+	if cx.aborted {
+		return true
+	}
+	if i < len(r.middleware) {
+		return r.middleware[i](cx, func() bool { return r.next(cx, i+1) })
+	}
+	return r.dispatch(cx)
+}
+
+func (r *Route) dispatch(cx *Context) bool {
 	var request interface{} = nil
 	if r.request != nil {
 		v := reflect.New(r.request.Elem())
-		err := Serializers.DecodeRequest(req, v.Interface())
+		err := cx.serializers().DecodeRequest(cx.Request, v.Interface())
 		if err != nil {
-			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			cx.RespondWithError(decodeErrorStatus(err), asDecodeError(err))
 			return true
 		}
 		request = v.Interface()
+		cx.decoded = request
+		if err := bindHeaders(cx.Request.Header, request); err != nil {
+			cx.RespondWithError(http.StatusBadRequest, err)
+			return true
+		}
+		if validator, ok := request.(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				cx.RespondWithError(http.StatusUnprocessableEntity, err)
+				return true
+			}
+		}
+	}
+	for _, hook := range r.beforeDispatch {
+		if err := hook(cx, request); err != nil {
+			status := http.StatusBadRequest
+			if _, ok := err.(*DecodeError); ok {
+				status = http.StatusUnprocessableEntity
+			}
+			cx.RespondWithError(status, err)
+			return true
+		}
 	}
 	return r.handler(cx, request)
 }
 
 type NotFoundHandler struct{}
 
+// Responds with an enveloped 404, or a plain text one if the request does not
+// determine a response format.
 func (n *NotFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	cx := &Context{ResponseWriter: w, Request: r}
+	if cx.NegotiatedContentType() == "" {
+		writePlainTextError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
 	cx.RespondWithStatus(http.StatusNotFound)
 }
 
 type Service struct {
 	Root            string
 	FallbackHandler http.Handler
-	routes          []*Route
+	// Trust X-Forwarded-* and X-Real-IP headers set by a single reverse
+	// proxy.
+	TrustProxy bool
+	// Compress responses with brotli or gzip when the client accepts it.
+	Compress bool
+	// Query parameter (eg. "format") whose value, a key of FormatTokens,
+	// overrides Accept negotiation. Unknown values are ignored.
+	FormatQueryParam string
+	// Strip an extension that is a key of FormatTokens (eg. ".json") from
+	// request paths before matching, and respond in that format.
+	ExtensionNegotiation bool
+	// Redirect requests that only match a route with a trailing slash added
+	// or removed. GET and HEAD receive 301, other methods 308 so that the
+	// method and body are preserved.
+	StrictSlash bool
+	// Respond to OPTIONS requests not handled by a route with the allowed
+	// methods for the path, and to CORS preflight requests if CORS is set.
+	AutoOptions bool
+	// Cross-origin resource sharing configuration. Disabled if nil.
+	CORS *CORSOptions
+	// Reject JSON request bodies containing fields that are not present in
+	// the value being decoded into. This and the other JSON options apply
+	// to the *JsonSerializer registered in Serializers, not custom ones.
+	DisallowUnknownFields bool
+	// Content type for error responses, regardless of negotiation.
+	// Successful responses are negotiated as usual.
+	ErrorContentType string
+	// Indent JSON responses with this string, eg. "  ", for readability.
+	Indent string
+	// Stream slice data in JSON responses element by element. See
+	// JsonSerializer.StreamEnvelope.
+	StreamJSON bool
+	// Maximum size in bytes of request bodies. Zero means unlimited. Routes
+	// may override this with MaxBody.
+	MaxBodyBytes int64
+	// Called with the raw request before routing. Returning false, after
+	// writing a response, stops the request from being routed.
+	PreRouteHook func(w http.ResponseWriter, r *http.Request) bool
+	// Destination for internal logging: dispatch errors, internal errors,
+	// recovered panics and failures writing responses. Defaults to the
+	// standard logger.
+	Logger Logger
+	// Called after any response with a status of 400 or above, including
+	// those from the FallbackHandler, eg. to report errors.
+	OnError func(cx *Context, status int)
+	// Called when writing a response to the client fails, eg. because the
+	// client disconnected. Defaults to logging the error.
+	WriteErrorHandler func(cx *Context, err error)
+	// Called with every enveloped response just before it is encoded, and
+	// may modify it.
+	ResponseInterceptor func(cx *Context, resp *Response)
+	// Respond with 201 Created to POST handlers that respond without giving
+	// a status (with RespondWithData or Write), and with 204 No Content to
+	// PUT and DELETE handlers that respond with nothing. Explicit statuses,
+	// including 200, are kept.
+	RESTStatusConventions bool
+	// Request header carrying the client's API version for VersionTransform.
+	// Defaults to X-API-Version.
+	VersionHeader string
+	// Server-wide context whose values are visible through each request's
+	// context. Request values take precedence; cancellation and deadlines
+	// come from the request only.
+	BaseContext context.Context
+	// Clock used wherever the service needs the current time.
+	Now              func() time.Time
+	routes           []*Route
+	roots            []string
+	errorMappings    []errorMapping
+	pathSyntax       PathSyntax
+	versionTransform func(version string, resp *Response)
+	mu               sync.Mutex // Guards routes and building index.
+	index            atomic.Pointer[routeIndex]
+	derived          atomic.Pointer[derivedSerializers]
+}
+
+// A request context that falls back to base for values.
+type baseContext struct {
+	context.Context
+	base context.Context
+}
+
+func (b *baseContext) Value(key interface{}) interface{} {
+	if v := b.Context.Value(key); v != nil {
+		return v
+	}
+	return b.base.Value(key)
 }
 
 func NewService(root string) *Service {
 	return &Service{
 		Root:            root,
 		FallbackHandler: &NotFoundHandler{},
+		Now:             time.Now,
 	}
 }
 
 func (s *Service) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	for _, route := range s.routes {
-		args := route.match(req)
+	if s.PreRouteHook != nil && !s.PreRouteHook(writer, req) {
+		return
+	}
+	if s.BaseContext != nil {
+		req = req.WithContext(&baseContext{req.Context(), s.BaseContext})
+	}
+	routed := req
+	if s.ExtensionNegotiation {
+		routed = stripExtension(req)
+	}
+	if s.CORS != nil && req.Method != "OPTIONS" {
+		s.CORS.setOriginHeaders(writer, req)
+	}
+	index := s.routeIndex()
+	start := 0
+	// Routes that keep extensions may match the unstripped path, which the
+	// index does not account for.
+	if static, ok := index.static[req.Method+" "+requestPath(req)]; ok && routed == req {
+		if static.route.apply([]string{requestPath(req)}, writer, req) {
+			return
+		}
+		start = static.index + 1
+	}
+	for _, route := range index.routes[start:] {
+		routeReq := routed
+		if route.keepExtension {
+			routeReq = req
+		}
+		args := route.match(routeReq)
 		if len(args) != 0 {
-			if route.apply(args, writer, req) {
+			if route.apply(args, writer, routeReq) {
 				return
 			}
 		}
 	}
+	req = routed
+	if s.OnError != nil {
+		recorder := &responseRecorder{ResponseWriter: writer}
+		writer = recorder
+		defer func() {
+			if recorder.status >= 400 {
+				s.OnError(&Context{ResponseWriter: writer, Request: req, service: s}, recorder.status)
+			}
+		}()
+	}
+	if s.StrictSlash {
+		if location, ok := s.slashRedirect(req); ok {
+			status := http.StatusMovedPermanently
+			if req.Method != "GET" && req.Method != "HEAD" {
+				// Unlike 301, 308 requires clients to repeat the method.
+				status = http.StatusPermanentRedirect
+			}
+			http.Redirect(writer, req, location, status)
+			return
+		}
+	}
+	if s.AutoOptions && req.Method == "OPTIONS" {
+		if methods := s.allowedMethods(requestPath(req)); len(methods) != 0 {
+			s.respondOptions(writer, req, methods)
+			return
+		}
+	}
 	s.FallbackHandler.ServeHTTP(writer, req)
 }
 
+// The request URI with its trailing slash added or removed, if that matches
+// a route that the request itself did not.
+func (s *Service) slashRedirect(req *http.Request) (string, bool) {
+	path := requestPath(req)
+	if path == "/" || path == "" {
+		return "", false
+	}
+	alternate := path + "/"
+	if strings.HasSuffix(path, "/") {
+		alternate = strings.TrimSuffix(path, "/")
+	}
+	for _, route := range s.currentRoutes() {
+		if len(route.matchPath(req.Method, alternate)) != 0 {
+			return alternate + req.RequestURI[len(path):], true
+		}
+	}
+	return "", false
+}
+
+// Find the route that would be tried first for a request, without
+// dispatching to it. Returns the route and its extracted path parameters.
+// Note that ServeHTTP will fall through to later routes if the arguments
+// can not be coerced to the handler's parameter types. path may include a
+// query string, for routes with Query conditions. As with ServeHTTP, format
+// extensions are removed under ExtensionNegotiation.
+func (s *Service) Match(method, path string) (*Route, map[string]string, bool) {
+	query := url.Values{}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		query, _ = url.ParseQuery(path[i+1:])
+		path = path[:i]
+	}
+	stripped := path
+	if s.ExtensionNegotiation {
+		stripped, _, _ = splitExtension(path)
+	}
+	for _, route := range s.currentRoutes() {
+		routePath := stripped
+		if route.keepExtension {
+			routePath = path
+		}
+		args := route.matchPath(method, routePath)
+		if len(args) != 0 && route.matchQuery(query) {
+			return route, route.paramMap(args), true
+		}
+	}
+	return nil, nil, false
+}
+
 func (s *Service) Find(name string) *Route {
-	for _, r := range s.routes {
+	for _, r := range s.currentRoutes() {
 		if r.name == name {
 			return r
 		}
@@ -274,15 +935,143 @@ func (s *Service) Find(name string) *Route {
 	return nil
 }
 
+// Routes whose full path, including the service root, starts with
+// pathPrefix, in matching order.
+func (s *Service) FindByPrefix(pathPrefix string) []*Route {
+	routes := []*Route{}
+	for _, r := range s.currentRoutes() {
+		if strings.HasPrefix(r.fullPath(), pathPrefix) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// The global Serializers with the service's JSON options applied, built
+// when first needed after the options or the registered JSON serializer
+// change.
+type derivedSerializers struct {
+	base                  *JsonSerializer
+	disallowUnknownFields bool
+	indent                string
+	streamJSON            bool
+	serializers           SerializerMap
+}
+
+// The global Serializers, with the service's JSON options applied to a copy
+// of the registered *JsonSerializer. A custom JSON serializer is used
+// unchanged, as are serializers registered after the options are first
+// used.
+func (s *Service) serializers() SerializerMap {
+	if !s.DisallowUnknownFields && s.Indent == "" && !s.StreamJSON {
+		return Serializers
+	}
+	base, ok := Serializers["application/json"].(*JsonSerializer)
+	if !ok {
+		return Serializers
+	}
+	derived := s.derived.Load()
+	if derived != nil && derived.base == base && derived.disallowUnknownFields == s.DisallowUnknownFields &&
+		derived.indent == s.Indent && derived.streamJSON == s.StreamJSON {
+		return derived.serializers
+	}
+	json := *base
+	json.DisallowUnknownFields = json.DisallowUnknownFields || s.DisallowUnknownFields
+	json.StreamEnvelope = json.StreamEnvelope || s.StreamJSON
+	if s.Indent != "" {
+		json.Indent = s.Indent
+	}
+	derived = &derivedSerializers{
+		base:                  base,
+		disallowUnknownFields: s.DisallowUnknownFields,
+		indent:                s.Indent,
+		streamJSON:            s.StreamJSON,
+		serializers:           Serializers.With("application/json", &json),
+	}
+	s.derived.Store(derived)
+	return derived.serializers
+}
+
+// Additionally serve all routes under prefix, including routes registered
+// later. Reversed paths always use Root.
+func (s *Service) AddRoot(prefix string) {
+	s.roots = append(s.roots, prefix)
+	for _, route := range s.currentRoutes() {
+		route.compilePath()
+	}
+}
+
 func (s *Service) route() *Route {
 	route := NewRoute()
+	route.service = s
 	if s.Root != "" {
 		route.Prefix(s.Root)
 	}
-	s.routes = append(s.routes, route)
+	s.updateRoutes(func(routes []*Route) []*Route {
+		return append(routes, route)
+	})
 	return route
 }
 
+// Add a route built with NewRoute, placing it under the service root. May be
+// called while the service is serving requests, unlike the route builders,
+// as long as the route is complete when added.
+func (s *Service) AddRoute(r *Route) {
+	r.service = s
+	r.path = s.pathSyntax.translate(r.path)
+	if s.Root != "" {
+		r.Prefix(s.Root)
+	} else {
+		r.compilePath()
+	}
+	s.updateRoutes(func(routes []*Route) []*Route {
+		return append(routes, r)
+	})
+}
+
+// Remove the routes with the given name, returning false if there were none.
+// May be called while the service is serving requests.
+func (s *Service) RemoveRoute(name string) bool {
+	removed := false
+	s.updateRoutes(func(routes []*Route) []*Route {
+		kept := routes[:0]
+		for _, r := range routes {
+			if r.name == name {
+				removed = true
+				continue
+			}
+			kept = append(kept, r)
+		}
+		return kept
+	})
+	return removed
+}
+
+func (s *Service) sortRoutes() {
+	s.updateRoutes(func(routes []*Route) []*Route {
+		return routes
+	})
+}
+
+// Transform enveloped responses for the API version given in the request's
+// VersionHeader, before they are encoded, eg. to keep a legacy layout for
+// old clients. version is "" if the header is absent.
+func (s *Service) VersionTransform(transform func(version string, resp *Response)) {
+	s.versionTransform = transform
+}
+
+// Register routes only if cond holds, eg. for feature flags:
+//
+//	s.When(flags.Beta).Get().Path("beta").ToFunction(beta)
+//
+// Otherwise routes are added to a detached service that never serves them.
+func (s *Service) When(cond bool) *Service {
+	if cond {
+		return s
+	}
+	return NewService(s.Root)
+}
+
 func (s *Service) Get() *Route {
 	return s.route().Get()
 }
@@ -299,6 +1088,10 @@ func (s *Service) Delete() *Route {
 	return s.route().Delete()
 }
 
+func (s *Service) Any() *Route {
+	return s.route().Any()
+}
+
 func (s *Service) Path(path string) *Route {
 	return s.route().Path(path)
 }
@@ -326,22 +1119,473 @@ type Context struct {
 	Args           []string
 	ResponseWriter http.ResponseWriter
 	Request        *http.Request
+	service        *Service
+	route          *Route
+	recorder       *responseRecorder
+	status         int
+	responded      bool
+	passThrough    bool
+	aborted        bool
+	writing        bool
+	formParsed     bool
+	formErr        error
+	decoded        interface{}
+}
+
+// The request's context, including values from the service's BaseContext.
+func (c *Context) Context() context.Context {
+	return c.Request.Context()
+}
+
+// Attach a request-scoped value, eg. from middleware, for retrieval by later
+// middleware and handlers with Value.
+func (c *Context) SetValue(key, value interface{}) {
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), key, value))
+}
+
+// The request context value for key, if present and of type T.
+func Value[T any](cx *Context, key interface{}) (T, bool) {
+	v, ok := cx.Context().Value(key).(T)
+	return v, ok
+}
+
+// The current time according to the service clock.
+func (c *Context) now() time.Time {
+	if c.service != nil && c.service.Now != nil {
+		return c.service.Now()
+	}
+	return time.Now()
+}
+
+// The value of the named path parameter, or "" if there is none.
+func (c *Context) Param(name string) string {
+	value, _ := c.lookupParam(name)
+	return value
+}
+
+func (c *Context) lookupParam(name string) (string, bool) {
+	if c.route == nil {
+		return "", false
+	}
+	for i, param := range c.route.params {
+		if param == name && i < len(c.Args) {
+			return c.Args[i], true
+		}
+	}
+	return "", false
+}
+
+// Coerce the named path parameter to t.
+func (c *Context) coerceParam(name string, t reflect.Type) (reflect.Value, error) {
+	value, ok := c.lookupParam(name)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("unknown parameter %q", name)
+	}
+	v, err := coerce(value, t)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid parameter %q: %s", name, err)
+	}
+	return v, nil
+}
+
+func (c *Context) ParamInt(name string) (int, error) {
+	v, err := c.coerceParam(name, reflect.TypeOf(0))
+	if err != nil {
+		return 0, err
+	}
+	return v.Interface().(int), nil
+}
+
+func (c *Context) ParamInt64(name string) (int64, error) {
+	v, err := c.coerceParam(name, reflect.TypeOf(int64(0)))
+	if err != nil {
+		return 0, err
+	}
+	return v.Interface().(int64), nil
+}
+
+func (c *Context) ParamFloat(name string) (float64, error) {
+	v, err := c.coerceParam(name, reflect.TypeOf(0.0))
+	if err != nil {
+		return 0, err
+	}
+	return v.Interface().(float64), nil
+}
+
+// The request args, with a trailing catch-all arg split into its path
+// segments.
+func (c *Context) expandCatchAll() []string {
+	if c.route == nil || !c.route.catchAll || len(c.Args) != len(c.route.params) {
+		return c.Args
+	}
+	last := len(c.Args) - 1
+	if c.Args[last] == "" {
+		return c.Args[:last]
+	}
+	return append(append([]string{}, c.Args[:last]...), strings.Split(c.Args[last], "/")...)
+}
+
+// Once the handler returns, continue routing with the next matching route as
+// if this one had not matched. Headers already set on the ResponseWriter are
+// kept, and a request body that has been read will not be available again.
+// Returns AlreadyResponded if a response has been written.
+func (c *Context) PassThrough() error {
+	if c.responded {
+		return AlreadyResponded
+	}
+	c.passThrough = true
+	return nil
+}
+
+// Stop the rest of the middleware chain and the handler from running, eg.
+// after middleware has responded with an authentication failure.
+func (c *Context) Abort() {
+	c.aborted = true
+}
+
+func (c *Context) IsAborted() bool {
+	return c.aborted
+}
+
+// Report a failed write to the client.
+func (c *Context) writeError(err error) {
+	if c.service != nil && c.service.WriteErrorHandler != nil {
+		c.service.WriteErrorHandler(c, err)
+		return
+	}
+	c.logf("error writing response to %s %s: %s", c.Request.Method, c.Request.URL, err)
+}
+
+// The route converter for the i'th arg, if any.
+func (c *Context) converter(i int) func(string) (interface{}, error) {
+	if c.route == nil || len(c.route.params) == 0 {
+		return nil
+	}
+	if i >= len(c.route.params) {
+		i = len(c.route.params) - 1
+	}
+	return c.route.converters[c.route.params[i]]
+}
+
+// The serializers configured for the service, or the global Serializers.
+func (c *Context) serializers() SerializerMap {
+	if c.service == nil {
+		return Serializers
+	}
+	return c.service.serializers()
+}
+
+func (c *Context) trustProxy() bool {
+	return c.service != nil && c.service.TrustProxy
+}
+
+// The IP address of the client. If the service trusts its proxy,
+// X-Forwarded-For and X-Real-IP are consulted first. Only the last
+// X-Forwarded-For entry, the one appended by the proxy, is used, as the
+// client controls any before it.
+func (c *Context) ClientIP() string {
+	if c.trustProxy() {
+		if fwd := c.Request.Header.Values("X-Forwarded-For"); len(fwd) != 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+		if ip := c.Request.Header.Get("X-Real-IP"); ip != "" {
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// The URL scheme ("http" or "https") the client used. If the service trusts
+// its proxy, X-Forwarded-Proto is consulted first.
+func (c *Context) Scheme() string {
+	if c.trustProxy() {
+		if proto := c.Request.Header.Get("X-Forwarded-Proto"); proto != "" {
+			return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+		}
+	}
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// The host the client requested. If the service trusts its proxy,
+// X-Forwarded-Host is consulted first.
+func (c *Context) Host() string {
+	if c.trustProxy() {
+		if host := c.Request.Header.Get("X-Forwarded-Host"); host != "" {
+			return strings.TrimSpace(strings.Split(host, ",")[0])
+		}
+	}
+	return c.Request.Host
+}
+
+// Reverse the named route into an absolute URL using the scheme and host of
+// the current request.
+func (c *Context) AbsoluteURL(routeName string, args Args) (string, error) {
+	if c.service == nil {
+		return "", fmt.Errorf("can't reverse route %q outside of a service", routeName)
+	}
+	route := c.service.Find(routeName)
+	if route == nil {
+		return "", fmt.Errorf("unknown route %q", routeName)
+	}
+	return c.Scheme() + "://" + c.Host() + route.Reverse(args), nil
+}
+
+// Record the status to use for the response without writing anything yet.
+// A subsequent success (200) response will use this status instead.
+func (c *Context) SetStatus(status int) {
+	c.status = status
+}
+
+// Equivalent to SetStatus.
+func (c *Context) WriteHeader(status int) {
+	c.SetStatus(status)
+}
+
+// The status sent to the client, whether by the envelope methods or
+// directly through the ResponseWriter, or otherwise the status recorded by
+// SetStatus. 0 if neither has happened.
+func (c *Context) Status() int {
+	if c.recorder != nil && c.recorder.status != 0 {
+		return c.recorder.status
+	}
+	return c.status
+}
+
+// Start a manual response with status, claiming the response. Write the
+// body with Write.
+func (c *Context) WriteStatus(status int) error {
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
+	c.writing = true
+	c.ResponseWriter.WriteHeader(status)
+	return nil
+}
+
+// Write b to the response body without serialization, making Context an
+// io.Writer. The first Write starts a 200 response if WriteStatus has not
+// been called. Returns AlreadyResponded if an enveloped response was
+// written first, and envelope methods likewise fail after a Write.
+func (c *Context) Write(b []byte) (int, error) {
+	if !c.writing {
+		if err := c.WriteStatus(c.conventionalStatus(true)); err != nil {
+			return 0, err
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Check that no response has been written yet, and claim the response.
+// A recorded WriteHeader status replaces a plain 200.
+func (c *Context) claimResponse(status int) (int, error) {
+	if c.responded {
+		return status, AlreadyResponded
+	}
+	c.responded = true
+	if status == http.StatusOK && c.status != 0 {
+		status = c.status
+	}
+	return status, nil
+}
+
+// The status of a successful response whose handler did not give one: 200,
+// or under the service's RESTStatusConventions, 201 for POST and 204 for a
+// PUT or DELETE without a body. A status recorded with SetStatus wins.
+func (c *Context) conventionalStatus(hasBody bool) int {
+	if c.service == nil || !c.service.RESTStatusConventions || c.status != 0 {
+		return http.StatusOK
+	}
+	switch {
+	case c.Request.Method == "POST":
+		return http.StatusCreated
+	case !hasBody && (c.Request.Method == "PUT" || c.Request.Method == "DELETE"):
+		return http.StatusNoContent
+	}
+	return http.StatusOK
 }
 
 func (c *Context) Respond(status int, error string, data interface{}) error {
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
 	var E interface{} = nil
 	if error != "" {
 		E = error
 	}
-	return Serializers.EncodeResponse(c.Request, c.ResponseWriter, &Response{S: status, E: E, D: data})
+	return c.encode(&Response{S: status, E: E, D: data})
+}
+
+// Encode response, whose status has already been claimed, to the client.
+func (c *Context) encode(response *Response) error {
+	if response.E != nil && c.service != nil && c.service.ErrorContentType != "" {
+		return c.encodeAs(c.service.ErrorContentType, response)
+	}
+	if ct, ok := c.formatOverride(); ok {
+		return c.encodeAs(ct, response)
+	}
+	c.intercept(response)
+	return c.serializers().EncodeResponse(c.Request, c.ResponseWriter, response)
+}
+
+// Encode response, whose status has already been claimed, as ct.
+func (c *Context) encodeAs(ct string, response *Response) error {
+	c.intercept(response)
+	return c.serializers().EncodeResponseAs(ct, c.ResponseWriter, response)
+}
+
+func (c *Context) intercept(response *Response) {
+	if c.service == nil {
+		return
+	}
+	if c.service.versionTransform != nil {
+		header := c.service.VersionHeader
+		if header == "" {
+			header = "X-API-Version"
+		}
+		addVary(c.ResponseWriter.Header(), header)
+		c.service.versionTransform(c.Request.Header.Get(header), response)
+	}
+	if c.service.ResponseInterceptor != nil {
+		c.service.ResponseInterceptor(c, response)
+	}
+}
+
+// The content type that a response to this request will be encoded as, or
+// "" if negotiation fails.
+func (c *Context) NegotiatedContentType() string {
+	if ct, ok := c.formatOverride(); ok {
+		return ct
+	}
+	ct, _, _ := c.serializers().Negotiate(c.Request)
+	return ct
+}
+
+// Call the branch keyed by the content type that best matches the request's
+// Accept header, returning its error. Branches are responsible for writing
+// the response. If no branch is acceptable, respond with 406 Not Acceptable
+// and return UnsupportedContentType.
+func (c *Context) Negotiate(branches map[string]func() error) error {
+	offers := make([]string, 0, len(branches))
+	for ct := range branches {
+		offers = append(offers, ct)
+	}
+	addVary(c.ResponseWriter.Header(), "Accept")
+	ct, ok := c.serializers().negotiateOffers(c.Request.Header.Get("Accept"), offers)
+	if !ok {
+		if _, err := c.claimResponse(http.StatusNotAcceptable); err != nil {
+			return err
+		}
+		writePlainTextError(c.ResponseWriter, http.StatusNotAcceptable, fmt.Sprintf("%s: %s", UnsupportedContentType, c.Request.Header.Get("Accept")))
+		return UnsupportedContentType
+	}
+	return branches[ct]()
+}
+
+// The content type requested via a path extension or the service's
+// FormatQueryParam, if any.
+func (c *Context) formatOverride() (string, bool) {
+	if ct, ok := c.Request.Context().Value(extensionKey{}).(string); ok {
+		return ct, true
+	}
+	if c.service == nil || c.service.FormatQueryParam == "" {
+		return "", false
+	}
+	ct, ok := FormatTokens[c.Request.URL.Query().Get(c.service.FormatQueryParam)]
+	return ct, ok
+}
+
+// Respond with data serialized as ct, bypassing negotiation.
+func (c *Context) RespondAs(ct string, status int, data interface{}) error {
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
+	return c.encodeAs(ct, &Response{S: status, D: data})
+}
+
+// Respond with data as JSON regardless of the Accept header.
+func (c *Context) JSON(status int, data interface{}) error {
+	return c.RespondAs("application/json", status, data)
+}
+
+// Respond with data as msgpack regardless of the Accept header.
+func (c *Context) MsgPack(status int, data interface{}) error {
+	return c.RespondAs("application/x-msgpack", status, data)
+}
+
+// Respond with data as BSON regardless of the Accept header.
+func (c *Context) BSON(status int, data interface{}) error {
+	return c.RespondAs("application/bson", status, data)
 }
 
 func (c *Context) RespondWithErrorMessage(error string, status int) error {
 	return c.Respond(status, error, nil)
 }
 
+// Decode the request body into v. The body is only read once: later calls,
+// including after the route's DecodeRequest, receive a copy of the first
+// decoded value, which must be of the same type as v.
 func (c *Context) Receive(v interface{}) error {
-	return Serializers.DecodeRequest(c.Request, v)
+	if c.decoded != nil {
+		decoded := reflect.ValueOf(c.decoded)
+		target := reflect.ValueOf(v)
+		if decoded.Type() != target.Type() || target.Kind() != reflect.Ptr {
+			return fmt.Errorf("request already decoded as %T, not %T", c.decoded, v)
+		}
+		target.Elem().Set(decoded.Elem())
+		return nil
+	}
+	if err := c.serializers().DecodeRequest(c.Request, v); err != nil {
+		return err
+	}
+	c.decoded = v
+	return nil
+}
+
+// The decoded request, from the route's DecodeRequest or the first call to
+// Receive, or nil if the request has not been decoded.
+func (c *Context) Decoded() interface{} {
+	return c.decoded
+}
+
+// Decode the request body into v as JSON, whatever its Content-Type. A body
+// exceeding the route's limit fails with an *http.MaxBytesError, which
+// callers should report as 413 Request Entity Too Large.
+func (c *Context) BindJSON(v interface{}) error {
+	return c.serializers().Decode("application/json", c.Request.Body, v)
+}
+
+// Decode the request body into v. On failure, responds with 400 Bad Request,
+// or 413 Request Entity Too Large if the body exceeds the route's limit, and
+// returns false.
+func (c *Context) MustReceive(v interface{}) bool {
+	if err := c.Receive(v); err != nil {
+		c.RespondWithError(decodeErrorStatus(err), asDecodeError(err))
+		return false
+	}
+	return true
+}
+
+// The status for a failure to decode a request body: 413 Request Entity Too
+// Large if it exceeded the body limit, otherwise 400 Bad Request.
+func decodeErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
 }
 
 func (c *Context) RespondWithStatus(status int) error {
@@ -349,14 +1593,77 @@ func (c *Context) RespondWithStatus(status int) error {
 }
 
 func (c *Context) RespondWithData(v interface{}) error {
-	return c.Respond(200, "", v)
+	return c.Respond(c.conventionalStatus(true), "", v)
+}
+
+// Write body verbatim with the given status and content type, bypassing
+// serialization.
+func (c *Context) RespondRaw(status int, contentType string, body []byte) error {
+	status, err := c.claimResponse(status)
+	if err != nil {
+		return err
+	}
+	c.ResponseWriter.Header().Set("Content-Type", contentType)
+	c.ResponseWriter.WriteHeader(status)
+	_, err = c.ResponseWriter.Write(body)
+	return err
+}
+
+// Respond with 503 Service Unavailable, asking the client to retry after
+// the given duration.
+func (c *Context) Unavailable(retryAfter time.Duration) error {
+	setRetryAfter(c.ResponseWriter.Header(), retryAfter)
+	return c.RespondWithStatus(http.StatusServiceUnavailable)
+}
+
+// Set the Retry-After header to d, rounded up to whole seconds.
+func setRetryAfter(header http.Header, d time.Duration) {
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// Respond with 201 Created, a Location header pointing at the new resource,
+// and the serialized data.
+func (c *Context) Created(location string, data interface{}) error {
+	c.ResponseWriter.Header().Set("Location", location)
+	return c.Respond(http.StatusCreated, "", data)
 }
 
 func coerce(s string, t reflect.Type) (reflect.Value, error) {
+	coercionsLock.RLock()
+	coercion, ok := coercions[t]
+	coercionsLock.RUnlock()
+	if ok {
+		return coercion(s)
+	}
+	v, err := coerceKind(s, t)
+	if err != nil {
+		return v, err
+	}
+	// Named types (eg. type ID string) must be converted to be used in calls.
+	return v.Convert(t), nil
+}
+
+// Whether a coercion is registered for t.
+func hasCoercion(t reflect.Type) bool {
+	coercionsLock.RLock()
+	defer coercionsLock.RUnlock()
+	_, ok := coercions[t]
+	return ok
+}
+
+// Parse s as a value of the kind of t.
+func coerceKind(s string, t reflect.Type) (reflect.Value, error) {
+	// Tolerate whitespace around numbers, but keep strings verbatim.
+	if t.Kind() != reflect.String {
+		s = strings.TrimSpace(s)
+	}
 	switch t.Kind() {
 	case reflect.Int:
-		v, err := strconv.ParseInt(s, 10, 64)
+		v, err := strconv.ParseInt(s, 10, strconv.IntSize)
 		return reflect.ValueOf(int(v)), err
+	case reflect.Uint:
+		v, err := strconv.ParseUint(s, 10, strconv.IntSize)
+		return reflect.ValueOf(uint(v)), err
 	case reflect.Int8:
 		v, err := strconv.ParseInt(s, 10, 8)
 		return reflect.ValueOf(int8(v)), err
@@ -392,3 +1699,18 @@ func coerce(s string, t reflect.Type) (reflect.Value, error) {
 	}
 	return reflect.ValueOf(s), errors.New("unsupported argument type " + t.String())
 }
+
+var (
+	coercionsLock sync.RWMutex
+	coercions     = map[reflect.Type]func(string) (reflect.Value, error){}
+)
+
+// Register fn to coerce path arguments and bound values to t, eg. to parse
+// UUIDs uniformly across routes. fn must return a value of type t, and takes
+// precedence over the built-in coercions. Routes may still override it with
+// a converter.
+func RegisterCoercion(t reflect.Type, fn func(string) (reflect.Value, error)) {
+	coercionsLock.Lock()
+	defer coercionsLock.Unlock()
+	coercions[t] = fn
+}
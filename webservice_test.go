@@ -1,12 +1,22 @@
 package webservice
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchrcom/testify/assert"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Req struct {
@@ -53,3 +63,1975 @@ func TestRequestDecodingBson(t *testing.T) {
 func TestRequestDecodingJson(t *testing.T) {
 	testEncoderDecoder(t, "application/json")
 }
+
+func newTestRequest(method, url string, body io.Reader, ct string) *http.Request {
+	req := httptest.NewRequest(method, url, body)
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set("Accept", ct)
+	}
+	return req
+}
+
+func decodeTestResponse(t *testing.T, ct string, writer *httptest.ResponseRecorder, data interface{}) *Response {
+	resp := &Response{D: data}
+	err := Serializers.Decode(ct, writer.Body, resp)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestCreated(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("things").ToFunction(func(cx *Context) {
+		cx.Created("/things/1", &Req{Seen: true, Message: "created"})
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/things", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusCreated)
+	assert.Equal(t, writer.Header().Get("Location"), "/things/1")
+	resp := decodeTestResponse(t, "application/json", writer, &Req{})
+	assert.Equal(t, resp.S, http.StatusCreated)
+	assert.Equal(t, resp.D.(*Req).Message, "created")
+}
+
+func TestReceivePatch(t *testing.T) {
+	var ops []PatchOp
+	s := NewService("/")
+	s.Path("things/{id}").ToFunction(func(cx *Context, id int) {
+		var err error
+		ops, err = cx.ReceivePatch()
+		assert.NoError(t, err)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	body := `[
+		{"op": "add", "path": "/tags/0", "value": "new"},
+		{"op": "replace", "path": "/name", "value": "thing"},
+		{"op": "remove", "path": "/old"}
+	]`
+	// Responses are never labelled as patches, whatever the client accepts.
+	for _, accept := range []string{"application/json", "*/*"} {
+		req := newTestRequest("PATCH", "/things/1", strings.NewReader(body), "application/json-patch+json")
+		req.Header.Set("Accept", accept)
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusOK, accept)
+		assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8", accept)
+		assert.Equal(t, ops, []PatchOp{
+			{Op: "add", Path: "/tags/0", Value: "new"},
+			{Op: "replace", Path: "/name", Value: "thing"},
+			{Op: "remove", Path: "/old"},
+		}, accept)
+	}
+
+	// Without an Accept header, the request does not determine a format, as
+	// for forms.
+	req := newTestRequest("PATCH", "/things/1", strings.NewReader(body), "application/json-patch+json")
+	req.Header.Del("Accept")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+}
+
+func TestReceivePatchInvalidOp(t *testing.T) {
+	req := newTestRequest("PATCH", "/", strings.NewReader(`[{"op": "frobnicate", "path": "/"}]`), "application/json-patch+json")
+	cx := &Context{ResponseWriter: httptest.NewRecorder(), Request: req}
+	_, err := cx.ReceivePatch()
+	assert.Error(t, err)
+}
+
+func testClientInfo(t *testing.T, trust bool, headers map[string]string) (ip, scheme string) {
+	s := NewService("/")
+	s.TrustProxy = trust
+	s.Get().Path("info").ToFunction(func(cx *Context) {
+		ip = cx.ClientIP()
+		scheme = cx.Scheme()
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	req := newTestRequest("GET", "/info", nil, "application/json")
+	req.RemoteAddr = "10.0.0.1:1234"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	return
+}
+
+func TestClientInfoDirect(t *testing.T) {
+	ip, scheme := testClientInfo(t, false, nil)
+	assert.Equal(t, ip, "10.0.0.1")
+	assert.Equal(t, scheme, "http")
+}
+
+func TestClientInfoIgnoresUntrustedProxy(t *testing.T) {
+	ip, scheme := testClientInfo(t, false, map[string]string{
+		"X-Forwarded-For":   "1.2.3.4",
+		"X-Forwarded-Proto": "https",
+	})
+	assert.Equal(t, ip, "10.0.0.1")
+	assert.Equal(t, scheme, "http")
+}
+
+func TestClientInfoTrustedProxy(t *testing.T) {
+	ip, scheme := testClientInfo(t, true, map[string]string{
+		"X-Forwarded-For":   "1.2.3.4, 10.0.0.2",
+		"X-Forwarded-Proto": "https",
+	})
+	assert.Equal(t, ip, "10.0.0.2")
+	assert.Equal(t, scheme, "https")
+}
+
+func TestClientInfoTrustedProxyRealIP(t *testing.T) {
+	ip, _ := testClientInfo(t, true, map[string]string{"X-Real-IP": "5.6.7.8"})
+	assert.Equal(t, ip, "5.6.7.8")
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	var url string
+	var unknownErr error
+	s := NewService("/api")
+	s.TrustProxy = true
+	s.Get().Path("things/{id}").Named("thing").ToFunction(func(cx *Context, id int) {})
+	s.Post().Path("things").ToFunction(func(cx *Context) {
+		var err error
+		url, err = cx.AbsoluteURL("thing", Args{"id": "42"})
+		assert.NoError(t, err)
+		_, unknownErr = cx.AbsoluteURL("missing", nil)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	req := newTestRequest("POST", "/api/things", nil, "application/json")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, url, "https://example.com/api/things/42")
+	assert.Error(t, unknownErr)
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("limited").RateLimit(1, 2).ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", "/limited", nil, "application/json"))
+		codes = append(codes, writer.Code)
+		if writer.Code == http.StatusTooManyRequests {
+			assert.Equal(t, writer.Header().Get("Retry-After"), "1")
+		}
+	}
+	assert.Equal(t, codes, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests})
+}
+
+func TestRateLimitIgnoresSpoofedHops(t *testing.T) {
+	s := NewService("/")
+	s.TrustProxy = true
+	s.Get().Path("limited").RateLimit(1, 1).ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		req := newTestRequest("GET", "/limited", nil, "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.1.1.%d, 1.2.3.4", i))
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		codes = append(codes, writer.Code)
+	}
+	assert.Equal(t, codes, []int{http.StatusOK, http.StatusTooManyRequests})
+}
+
+func TestRateLimitPanicsOnInvalidRate(t *testing.T) {
+	assert.Panics(t, func() { NewRoute().RateLimit(0, 1) })
+	assert.Panics(t, func() { NewRoute().RateLimit(-1, 1) })
+	assert.Panics(t, func() { NewRoute().RateLimit(1, 0) })
+	assert.NotPanics(t, func() { NewRoute().RateLimit(0.5, 1) })
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newRateLimiter(2, 1)
+	ok, _ := limiter.allow("client", now)
+	assert.True(t, ok)
+	ok, wait := limiter.allow("client", now)
+	assert.False(t, ok)
+	assert.Equal(t, wait, 500*time.Millisecond)
+	ok, _ = limiter.allow("other", now)
+	assert.True(t, ok)
+	ok, _ = limiter.allow("client", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+}
+
+func TestRateLimiterEvictsOldestBucket(t *testing.T) {
+	defer func(n int) { RateLimitBuckets = n }(RateLimitBuckets)
+	RateLimitBuckets = 2
+	now := time.Unix(1000, 0)
+	limiter := newRateLimiter(1, 1)
+	limiter.allow("a", now)
+	limiter.allow("b", now)
+	limiter.allow("c", now)
+	assert.Equal(t, len(limiter.buckets), 2)
+	_, ok := limiter.buckets["a"]
+	assert.False(t, ok)
+}
+
+func TestServiceClock(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewService("/")
+	s.Now = func() time.Time { return now }
+	s.Get().Path("limited").RateLimit(1, 1).ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	get := func() int {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", "/limited", nil, "application/json"))
+		return writer.Code
+	}
+	assert.Equal(t, get(), http.StatusOK)
+	assert.Equal(t, get(), http.StatusTooManyRequests)
+	now = now.Add(time.Second)
+	assert.Equal(t, get(), http.StatusOK)
+}
+
+func TestRespondRaw(t *testing.T) {
+	body := []byte(`{"S":200,"E":null,"D":"cached"}`)
+	s := NewService("/")
+	s.Get().Path("cached").ToFunction(func(cx *Context) {
+		cx.RespondRaw(http.StatusOK, "application/json", body)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/cached", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json")
+	assert.Equal(t, writer.Body.Bytes(), body)
+}
+
+func TestUnsupportedAcceptIsPlainText(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData("thing")
+	})
+	req := newTestRequest("GET", "/thing", nil, "")
+	req.Header.Set("Accept", "application/foo")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusNotAcceptable)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, writer.Body.String(), "unsupported content type: application/foo\n")
+}
+
+func TestUnsupportedContentTypeIsPlainText(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("thing").DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {})
+	req := newTestRequest("POST", "/thing", strings.NewReader("hello"), "")
+	req.Header.Set("Content-Type", "application/foo")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, writer.Body.String(), "unsupported content type: application/foo\n")
+}
+
+func TestCoerceOverflow(t *testing.T) {
+	_, err := coerce("127", reflect.TypeOf(int8(0)))
+	assert.NoError(t, err)
+	_, err = coerce("128", reflect.TypeOf(int8(0)))
+	assert.Error(t, err)
+	_, err = coerce("-129", reflect.TypeOf(int8(0)))
+	assert.Error(t, err)
+	_, err = coerce("32768", reflect.TypeOf(int16(0)))
+	assert.Error(t, err)
+	_, err = coerce("65536", reflect.TypeOf(uint16(0)))
+	assert.Error(t, err)
+	_, err = coerce("-1", reflect.TypeOf(uint(0)))
+	assert.Error(t, err)
+	v, err := coerce("42", reflect.TypeOf(uint(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, v.Interface(), uint(42))
+}
+
+func TestWriteHeaderStatusUsedByResponse(t *testing.T) {
+	var second error
+	s := NewService("/")
+	s.Post().Path("jobs").ToFunction(func(cx *Context) {
+		cx.WriteHeader(http.StatusAccepted)
+		cx.ResponseWriter.Header().Set("X-Job", "1")
+		assert.NoError(t, cx.RespondWithData("queued"))
+		second = cx.RespondWithErrorMessage("conflict", http.StatusConflict)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/jobs", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusAccepted)
+	assert.Equal(t, writer.Header().Get("X-Job"), "1")
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.S, http.StatusAccepted)
+	assert.Equal(t, resp.D, "queued")
+	assert.Equal(t, second, AlreadyResponded)
+}
+
+// A ResponseRecorder whose connection can be hijacked.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestHandlerCanHijack(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("ws").ToHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		assert.True(t, ok)
+		_, _, err := hijacker.Hijack()
+		assert.NoError(t, err)
+	})
+	writer := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	s.ServeHTTP(writer, newTestRequest("GET", "/ws", nil, ""))
+	assert.True(t, writer.hijacked)
+}
+
+func TestNegotiatedResponseVariesOnAccept(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData("thing")
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/thing", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Vary"), "Accept")
+}
+
+func newTestSerializerMap() SerializerMap {
+	return SerializerMap{
+		"application/json":      &JsonSerializer{},
+		"application/x-msgpack": &MsgpackSerializer{},
+		"application/bson":      &BsonSerializer{},
+	}
+}
+
+// Restore the package negotiation settings changed by a test.
+func restoreNegotiation() func() {
+	preference, def := SerializerPreference, DefaultContentType
+	return func() {
+		SerializerPreference, DefaultContentType = preference, def
+	}
+}
+
+func TestNegotiationPreferenceBreaksTies(t *testing.T) {
+	defer restoreNegotiation()()
+	s := newTestSerializerMap()
+	s.SetPreference([]string{"application/bson", "application/json"})
+	ct, _, ok := s.negotiate("application/json, application/x-msgpack, application/bson", "")
+	assert.True(t, ok)
+	assert.Equal(t, ct, "application/bson")
+	ct, _, ok = s.negotiate("application/x-msgpack, application/json;q=0.9, application/bson;q=0.9", "")
+	assert.True(t, ok)
+	assert.Equal(t, ct, "application/x-msgpack")
+	ct, _, ok = s.negotiate("*/*", "")
+	assert.True(t, ok)
+	assert.Equal(t, ct, "application/bson")
+}
+
+func TestNegotiationFallbackOrder(t *testing.T) {
+	defer restoreNegotiation()()
+	s := newTestSerializerMap()
+	s.SetPreference([]string{"application/bson"})
+	ct, _, _ := s.negotiate("", "application/x-msgpack")
+	assert.Equal(t, ct, "application/x-msgpack")
+	ct, _, _ = s.negotiate("*/*", "application/x-msgpack; charset=utf-8")
+	assert.Equal(t, ct, "application/x-msgpack")
+	// The preference list is only consulted when there is an Accept header.
+	_, _, ok := s.negotiate("", "")
+	assert.False(t, ok)
+	DefaultContentType = "application/json"
+	ct, _, _ = s.negotiate("*/*", "")
+	assert.Equal(t, ct, "application/json")
+	ct, _, _ = s.negotiate("", "")
+	assert.Equal(t, ct, "application/json")
+	ct, _, _ = s.negotiate("application/*", "text/plain")
+	assert.Equal(t, ct, "application/json")
+	_, _, ok = s.negotiate("application/foo", "application/json")
+	assert.False(t, ok)
+}
+
+func TestSerializerMapIsAMap(t *testing.T) {
+	s := newTestSerializerMap()
+	s["text/csv"] = &JsonSerializer{}
+	delete(s, "application/bson")
+	assert.Equal(t, len(s), 3)
+	_, _, ok := s.negotiate("application/bson", "")
+	assert.False(t, ok)
+	ct, _, _ := s.negotiate("text/csv", "")
+	assert.Equal(t, ct, "text/csv")
+}
+
+func TestServiceMatch(t *testing.T) {
+	s := NewService("/api")
+	s.Get().Path("users/{id}/files/{path...}").Named("file").ToFunction(func(cx *Context, id int, path string) {})
+	route, params, ok := s.Match("GET", "/api/users/5/files/a/b.txt")
+	assert.True(t, ok)
+	assert.Equal(t, route, s.Find("file"))
+	assert.Equal(t, params, map[string]string{"id": "5", "path": "a/b.txt"})
+
+	_, _, ok = s.Match("POST", "/api/users/5/files/a/b.txt")
+	assert.False(t, ok)
+
+	_, _, ok = s.Match("GET", "/api/groups/5")
+	assert.False(t, ok)
+
+	s.ExtensionNegotiation = true
+	s.Get().Path("users/{id}").Named("user").ToFunction(func(cx *Context, id int) {})
+	s.Get().Path("exports/{name}").Named("export").KeepExtension().ToFunction(func(cx *Context, name string) {})
+	route, params, ok = s.Match("GET", "/api/users/5.json")
+	assert.True(t, ok)
+	assert.Equal(t, route, s.Find("user"))
+	assert.Equal(t, params, map[string]string{"id": "5"})
+	route, params, ok = s.Match("GET", "/api/exports/report.json")
+	assert.True(t, ok)
+	assert.Equal(t, route, s.Find("export"))
+	assert.Equal(t, params, map[string]string{"name": "report.json"})
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestDecodeStream(t *testing.T) {
+	body := &bytes.Buffer{}
+	body.WriteString("[")
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(body, `{"Seen": true, "Message": "%d"}`, i)
+	}
+	body.WriteString("]")
+	size := body.Len()
+	reader := &countingReader{r: body}
+	readAtFirst := 0
+	count := 0
+	s := NewService("/")
+	s.Post().Path("bulk").ToFunction(func(cx *Context) {
+		err := cx.DecodeStream(func(decode func(v interface{}) error) error {
+			req := &Req{}
+			if err := decode(req); err != nil {
+				return err
+			}
+			if count == 0 {
+				readAtFirst = reader.n
+			}
+			assert.Equal(t, req.Message, strconv.Itoa(count))
+			count++
+			return nil
+		})
+		assert.NoError(t, err)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/bulk", reader, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, count, 10000)
+	assert.True(t, readAtFirst < size/10)
+}
+
+func TestDecodeStreamRequiresArray(t *testing.T) {
+	req := newTestRequest("POST", "/", strings.NewReader(`{"Seen": true}`), "application/json")
+	cx := &Context{ResponseWriter: httptest.NewRecorder(), Request: req}
+	err := cx.DecodeStream(func(decode func(v interface{}) error) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestDecodeStreamRequiresDecode(t *testing.T) {
+	for ct, body := range map[string]io.Reader{
+		"application/json": strings.NewReader(`[{"Seen": true}]`),
+		"application/bson": concatenatedBson(t, "first"),
+	} {
+		req := newTestRequest("POST", "/", body, ct)
+		cx := &Context{ResponseWriter: httptest.NewRecorder(), Request: req}
+		err := cx.DecodeStream(func(decode func(v interface{}) error) error { return nil })
+		assert.Equal(t, err, StreamElementNotDecoded, ct)
+	}
+}
+
+func concatenatedBson(t *testing.T, messages ...string) *bytes.Buffer {
+	body := &bytes.Buffer{}
+	for _, message := range messages {
+		assert.NoError(t, Serializers.Encode("application/bson", body, &Req{Seen: true, Message: message}))
+	}
+	return body
+}
+
+func TestBsonDecodeSlice(t *testing.T) {
+	reqs := []Req{}
+	err := Serializers.Decode("application/bson", concatenatedBson(t, "first", "second"), &reqs)
+	assert.NoError(t, err)
+	assert.Equal(t, reqs, []Req{{Seen: true, Message: "first"}, {Seen: true, Message: "second"}})
+
+	req := &Req{}
+	assert.NoError(t, Serializers.Decode("application/bson", concatenatedBson(t, "first", "second"), req))
+	assert.Equal(t, req.Message, "first")
+
+	truncated := concatenatedBson(t, "first")
+	truncated.Truncate(truncated.Len() - 1)
+	assert.Error(t, Serializers.Decode("application/bson", truncated, &reqs))
+}
+
+func TestDecodeStreamBson(t *testing.T) {
+	messages := []string{}
+	req := newTestRequest("POST", "/", concatenatedBson(t, "first", "second"), "application/bson")
+	cx := &Context{ResponseWriter: httptest.NewRecorder(), Request: req}
+	err := cx.DecodeStream(func(decode func(v interface{}) error) error {
+		req := &Req{}
+		if err := decode(req); err != nil {
+			return err
+		}
+		messages = append(messages, req.Message)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, messages, []string{"first", "second"})
+}
+
+func TestForcedFormats(t *testing.T) {
+	formats := map[string]func(cx *Context, status int, data interface{}) error{
+		"application/json":      (*Context).JSON,
+		"application/x-msgpack": (*Context).MsgPack,
+		"application/bson":      (*Context).BSON,
+	}
+	for ct, respond := range formats {
+		respond := respond
+		s := NewService("/")
+		s.Get().Path("thing").ToFunction(func(cx *Context) {
+			respond(cx, http.StatusOK, &Req{Message: "forced"})
+		})
+		req := newTestRequest("GET", "/thing", nil, "")
+		req.Header.Set("Accept", "application/foo")
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusOK)
+		assert.Equal(t, writer.Header().Get("Content-Type"), withCharset(ct))
+		resp := &struct {
+			S int
+			D *Req
+		}{}
+		assert.NoError(t, Serializers.Decode(ct, writer.Body, resp))
+		assert.Equal(t, resp.D.Message, "forced")
+	}
+}
+
+func TestAnyMethod(t *testing.T) {
+	s := NewService("/")
+	s.Any().Path("proxy/{path...}").ToFunction(func(cx *Context, path string) {
+		cx.RespondWithData(cx.Request.Method + " " + path)
+	})
+	for _, method := range []string{"GET", "POST", "REPORT"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest(method, "/proxy/a/b", nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK)
+		resp := decodeTestResponse(t, "application/json", writer, nil)
+		assert.Equal(t, resp.D, method+" a/b")
+	}
+}
+
+func TestReverseCatchAll(t *testing.T) {
+	s := NewService("/files")
+	route := s.Get().Path("{bucket}/{path...}").ToFunction(func(cx *Context, bucket, path string) {})
+	assert.Equal(t, route.Reverse(Args{"bucket": "b", "path": "a/b c/d.txt"}), "/files/b/a/b%20c/d.txt")
+	assert.Equal(t, route.Reverse(Args{"bucket": "x/y", "path": "a"}), "/files/x%2Fy/a")
+	_, params, ok := s.Match("GET", route.Reverse(Args{"bucket": "b", "path": "a/b/c"}))
+	assert.True(t, ok)
+	assert.Equal(t, params["path"], "a/b/c")
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRespondWithReader(t *testing.T) {
+	reader := &closeRecorder{Reader: strings.NewReader("streamed body")}
+	s := NewService("/")
+	s.Get().Path("stream").ToFunction(func(cx *Context) {
+		cx.RespondWithReader(http.StatusOK, "text/plain", reader)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/stream", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, writer.Body.String(), "streamed body")
+	assert.True(t, reader.closed)
+}
+
+func TestRespondWithReaderRange(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("stream").ToFunction(func(cx *Context) {
+		cx.RespondWithReader(http.StatusOK, "text/plain", strings.NewReader("streamed body"))
+	})
+	req := newTestRequest("GET", "/stream", nil, "")
+	req.Header.Set("Range", "bytes=9-")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusPartialContent)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, writer.Body.String(), "body")
+}
+
+func TestFormatQueryParam(t *testing.T) {
+	s := NewService("/")
+	s.FormatQueryParam = "format"
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData("thing")
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/thing?format=json", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.D, "thing")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/thing?format=yaml", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/x-msgpack")
+}
+
+func TestVariadicHandler(t *testing.T) {
+	var bucket string
+	var parts []string
+	var ids []int
+	s := NewService("/")
+	s.Get().Path("files/{bucket}/{path...}").ToFunction(func(cx *Context, b string, p ...string) {
+		bucket = b
+		parts = p
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.Get().Path("sum/{a}/{b}").ToFunction(func(cx *Context, n ...int) {
+		ids = n
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/files/b/x/y/z.txt", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, bucket, "b")
+	assert.Equal(t, parts, []string{"x", "y", "z.txt"})
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/sum/1/2", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, ids, []int{1, 2})
+}
+
+func TestConvert(t *testing.T) {
+	currentUser := 42
+	var seen int
+	s := NewService("/")
+	s.Get().Path("users/{id}").Convert("id", func(s string) (interface{}, error) {
+		if s == "me" {
+			return currentUser, nil
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user %q", s)
+		}
+		return id, nil
+	}).ToFunction(func(cx *Context, id int) {
+		seen = id
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/me", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, seen, 42)
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/7", nil, "application/json"))
+	assert.Equal(t, seen, 7)
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/bob", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.E, `invalid user "bob"`)
+}
+
+func TestDefaultOptionalParameter(t *testing.T) {
+	var seen int
+	s := NewService("/")
+	route := s.Get().Path("items/{page?}").Default("page", "1").ToFunction(func(cx *Context, page int) {
+		seen = page
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	for path, page := range map[string]int{"/items": 1, "/items/": 1, "/items/3": 3} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK)
+		assert.Equal(t, seen, page)
+	}
+	assert.Equal(t, route.Reverse(Args{"page": "2"}), "/items/2")
+	assert.Equal(t, route.Reverse(nil), "/items")
+}
+
+func TestAddRoot(t *testing.T) {
+	s := NewService("/api")
+	before := s.Get().Path("users/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData(id)
+	})
+	s.AddRoot("/v1/")
+	s.Get().Path("groups/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData(id)
+	})
+	for _, path := range []string{"/api/users/1", "/v1/users/1", "/api/groups/1", "/v1/groups/1"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK)
+		resp := decodeTestResponse(t, "application/json", writer, nil)
+		assert.Equal(t, resp.D, float64(1))
+	}
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/v2/users/1", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.Equal(t, before.Reverse(Args{"id": "1"}), "/api/users/1")
+}
+
+func TestDecodeRequestIntoMap(t *testing.T) {
+	var seen map[string]interface{}
+	s := NewService("/")
+	s.Post().Path("map").DecodeRequest(&map[string]interface{}{}).ToFunction(func(cx *Context, req *map[string]interface{}) {
+		seen = *req
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/map", strings.NewReader(`{"a": 1, "b": "two"}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, seen, map[string]interface{}{"a": float64(1), "b": "two"})
+}
+
+func TestDecodeRequestIntoSlice(t *testing.T) {
+	var seen []Req
+	s := NewService("/")
+	s.Post().Path("slice").DecodeRequest(&[]Req{}).ToFunction(func(cx *Context, req []Req) {
+		seen = req
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`[{"Message": "a"}, {"Seen": true, "Message": "b"}]`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/slice", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, seen, []Req{{Message: "a"}, {Seen: true, Message: "b"}})
+}
+
+func TestDecodeRequestRequiresPointer(t *testing.T) {
+	assert.Panics(t, func() { NewRoute().DecodeRequest(map[string]interface{}{}) })
+}
+
+func TestNegotiatedContentType(t *testing.T) {
+	for _, ct := range []string{"application/json", "application/x-msgpack"} {
+		var negotiated string
+		s := NewService("/")
+		s.Get().Path("thing").ToFunction(func(cx *Context) {
+			negotiated = cx.NegotiatedContentType()
+			cx.RespondWithData("thing")
+		})
+		req := newTestRequest("GET", "/thing", nil, "")
+		req.Header.Set("Accept", ct)
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, negotiated, ct)
+		assert.Equal(t, writer.Header().Get("Content-Type"), withCharset(negotiated))
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("busy").ToFunction(func(cx *Context) {
+		cx.Unavailable(90*time.Second + time.Millisecond)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/busy", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, writer.Header().Get("Retry-After"), "91")
+}
+
+func TestMustReceive(t *testing.T) {
+	var ok bool
+	var req Req
+	s := NewService("/")
+	s.Post().Path("thing").ToFunction(func(cx *Context) {
+		req = Req{}
+		if ok = cx.MustReceive(&req); !ok {
+			return
+		}
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Message": "hi"}`), "application/json"))
+	assert.True(t, ok)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, req.Message, "hi")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Message": `), "application/json"))
+	assert.False(t, ok)
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.NotNil(t, resp.E)
+}
+
+func TestDecoded(t *testing.T) {
+	var arg, decoded interface{}
+	var received Req
+	var receiveErr, mismatchErr error
+	s := NewService("/")
+	s.Post().Path("thing").DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {
+		arg = req
+		decoded = cx.Decoded()
+		receiveErr = cx.Receive(&received)
+		mismatchErr = cx.Receive(&map[string]interface{}{})
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Message": "hi"}`), "application/json"))
+	assert.Equal(t, decoded, arg)
+	assert.Equal(t, decoded.(*Req).Message, "hi")
+	assert.NoError(t, receiveErr)
+	assert.Equal(t, received.Message, "hi")
+	assert.Error(t, mismatchErr)
+
+	// Without DecodeRequest, the first Receive populates Decoded.
+	s.Post().Path("lazy").ToFunction(func(cx *Context) {
+		decoded = cx.Decoded()
+		cx.Receive(&Req{})
+		arg = cx.Decoded()
+		received = Req{}
+		receiveErr = cx.Receive(&received)
+	})
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/lazy", strings.NewReader(`{"Message": "lazy"}`), "application/json"))
+	assert.Nil(t, decoded)
+	assert.Equal(t, arg.(*Req).Message, "lazy")
+	assert.NoError(t, receiveErr)
+	assert.Equal(t, received.Message, "lazy")
+}
+
+func TestMustReceiveTooLarge(t *testing.T) {
+	s := NewService("/")
+	s.MaxBodyBytes = 16
+	s.Post().Path("thing").ToFunction(func(cx *Context) {
+		cx.MustReceive(&Req{})
+	})
+	writer := httptest.NewRecorder()
+	body := strings.NewReader(`{"Message": "` + strings.Repeat("x", 64) + `"}`)
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", body, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestRoutePriority(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("{path...}").Priority(-1).ToFunction(func(cx *Context, path string) {
+		cx.RespondWithData("catch-all")
+	})
+	s.Get().Path("users/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData("user")
+	})
+	s.Get().Path("users/me").Priority(10).ToFunction(func(cx *Context) {
+		cx.RespondWithData("me")
+	})
+	for path, expected := range map[string]string{"/users/1": "user", "/users/me": "me", "/other": "catch-all"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		resp := decodeTestResponse(t, "application/json", writer, nil)
+		assert.Equal(t, resp.D, expected)
+	}
+}
+
+func TestBeforeDispatch(t *testing.T) {
+	called := false
+	s := NewService("/")
+	s.Post().Path("thing").DecodeRequest(&Req{}).BeforeDispatch(func(cx *Context, req interface{}) error {
+		if !req.(*Req).Seen {
+			return errors.New("must be seen")
+		}
+		return nil
+	}).ToFunction(func(cx *Context, req *Req) {
+		called = true
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Seen": false}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.False(t, called)
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.Equal(t, resp.E, "must be seen")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/thing", strings.NewReader(`{"Seen": true}`), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.True(t, called)
+}
+
+func TestResponseContentTypeCharset(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("thing").DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {
+		cx.RespondWithData(req.Message)
+	})
+	req := newTestRequest("POST", "/thing", strings.NewReader(`{"Message": "hi"}`), "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	assert.Equal(t, withCharset("application/x-msgpack"), "application/x-msgpack")
+	assert.Equal(t, withCharset("application/problem+json"), "application/problem+json; charset=utf-8")
+}
+
+func TestWildcardAcceptUsesCanonicalContentType(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData("thing")
+	})
+	for _, accept := range []string{"*/*", "application/*", "text/html;q=0.9, */*;q=0.8"} {
+		req := newTestRequest("GET", "/thing", nil, "")
+		req.Header.Set("Accept", accept)
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, writer.Code, http.StatusOK)
+		assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	}
+	req := newTestRequest("GET", "/thing", nil, "")
+	req.Header.Set("Accept", "application/json;q=0.8")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+}
+
+func TestResponseInterceptor(t *testing.T) {
+	s := NewService("/")
+	s.ResponseInterceptor = func(cx *Context, resp *Response) {
+		resp.D = map[string]interface{}{"data": resp.D, "server": "test"}
+	}
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		cx.RespondWithData("thing")
+	})
+	s.Get().Path("json").ToFunction(func(cx *Context) {
+		cx.JSON(http.StatusOK, "json")
+	})
+	for path, data := range map[string]string{"/thing": "thing", "/json": "json"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		resp := decodeTestResponse(t, "application/json", writer, nil)
+		assert.Equal(t, resp.D, map[string]interface{}{"data": data, "server": "test"})
+	}
+}
+
+func TestVersionTransform(t *testing.T) {
+	s := NewService("/")
+	s.VersionTransform(func(version string, resp *Response) {
+		if version == "1" {
+			resp.D.(map[string]interface{})["fullname"] = resp.D.(map[string]interface{})["name"]
+		}
+	})
+	s.Get().Path("user").ToFunction(func(cx *Context) {
+		cx.RespondWithData(map[string]interface{}{"name": "alice"})
+	})
+	for version, data := range map[string]interface{}{
+		"1": map[string]interface{}{"name": "alice", "fullname": "alice"},
+		"2": map[string]interface{}{"name": "alice"},
+		"":  map[string]interface{}{"name": "alice"},
+	} {
+		req := newTestRequest("GET", "/user", nil, "application/json")
+		if version != "" {
+			req.Header.Set("X-API-Version", version)
+		}
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, req)
+		assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, data, version)
+		assert.Contains(t, writer.Header().Get("Vary"), "X-API-Version")
+	}
+
+	s.VersionHeader = "Api-Version"
+	req := newTestRequest("GET", "/user", nil, "application/json")
+	req.Header.Set("Api-Version", "1")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, map[string]interface{}{"name": "alice", "fullname": "alice"})
+}
+
+func TestRESTStatusConventions(t *testing.T) {
+	s := NewService("/")
+	s.RESTStatusConventions = true
+	s.Post().Path("things").ToFunction(func(cx *Context) {
+		cx.RespondWithData("created")
+	})
+	s.Post().Path("accepted").ToFunction(func(cx *Context) {
+		cx.SetStatus(http.StatusAccepted)
+		cx.RespondWithData("queued")
+	})
+	s.Post().Path("ok").ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.Post().Path("written").ToFunction(func(cx *Context) {
+		cx.Write([]byte("created"))
+	})
+	s.Put().Path("things/{id}").ToFunction(func(cx *Context, id string) {
+		if id == "echo" {
+			cx.RespondWithData(id)
+		}
+	})
+	s.Delete().Path("things/{id}").ToFunction(func(cx *Context, id string) {})
+	s.Get().Path("things/{id}").ToFunction(func(cx *Context, id string) {})
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/things", http.StatusCreated},
+		{"POST", "/accepted", http.StatusAccepted},
+		{"POST", "/ok", http.StatusOK},
+		{"POST", "/written", http.StatusCreated},
+		{"PUT", "/things/1", http.StatusNoContent},
+		{"PUT", "/things/echo", http.StatusOK},
+		{"DELETE", "/things/1", http.StatusNoContent},
+		{"GET", "/things/1", http.StatusOK},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest(test.method, test.path, nil, "application/json"))
+		assert.Equal(t, writer.Code, test.status, test.method+" "+test.path)
+	}
+
+	s.RESTStatusConventions = false
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/things", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+}
+
+type testSlug struct {
+	Kind, Name string
+}
+
+func TestRegisterCoercion(t *testing.T) {
+	slugType := reflect.TypeOf(testSlug{})
+	RegisterCoercion(slugType, func(s string) (reflect.Value, error) {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 {
+			return reflect.Value{}, errors.New("invalid slug")
+		}
+		return reflect.ValueOf(testSlug{parts[0], parts[1]}), nil
+	})
+	defer func() {
+		coercionsLock.Lock()
+		delete(coercions, slugType)
+		coercionsLock.Unlock()
+	}()
+	s := NewService("/")
+	s.Get().Path("things/{slug}").ToFunction(func(cx *Context, slug testSlug) {
+		cx.RespondWithData(slug.Kind + "/" + slug.Name)
+	})
+	s.Get().Path("owners/{id}/things/{slug}").ToFunction(func(cx *Context, id int, slug testSlug) {
+		cx.RespondWithData(fmt.Sprintf("%d: %s/%s", id, slug.Kind, slug.Name))
+	})
+	assert.Equal(t, serveTestData(s, "GET", "/things/user:alice"), "user/alice")
+	assert.Equal(t, serveTestData(s, "GET", "/owners/3/things/team:core"), "3: team/core")
+	assert.Equal(t, serveTestData(s, "GET", "/things/alice"), http.StatusNotFound)
+
+	// Registered struct types are bound from a single value, not nested keys.
+	var query struct {
+		Slug  testSlug   `query:"slug"`
+		Slugs []testSlug `query:"slugs"`
+	}
+	req := newTestRequest("GET", "/?slug=user:bob&slugs=team:a&slugs=team:b", nil, "")
+	cx := &Context{Request: req}
+	assert.NoError(t, cx.BindQuery(&query))
+	assert.Equal(t, query.Slug, testSlug{"user", "bob"})
+	assert.Equal(t, query.Slugs, []testSlug{{"team", "a"}, {"team", "b"}})
+	req = newTestRequest("GET", "/?slug=bob", nil, "")
+	cx = &Context{Request: req}
+	assert.Error(t, cx.BindQuery(&query))
+}
+
+func TestTypedParams(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("points/{id}/{x}/{name}").ToFunction(func(cx *Context, id, x, name string) {
+		n, err := cx.ParamInt("id")
+		assert.NoError(t, err)
+		assert.Equal(t, n, 12)
+		n64, err := cx.ParamInt64("id")
+		assert.NoError(t, err)
+		assert.Equal(t, n64, int64(12))
+		f, err := cx.ParamFloat("x")
+		assert.NoError(t, err)
+		assert.Equal(t, f, 1.5)
+		assert.Equal(t, cx.Param("name"), "bob")
+		_, err = cx.ParamInt("name")
+		assert.Error(t, err)
+		_, err = cx.ParamInt("missing")
+		assert.Error(t, err)
+		assert.Equal(t, cx.Param("missing"), "")
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/points/12/1.5/bob", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+}
+
+func TestPreRouteHook(t *testing.T) {
+	called := false
+	s := NewService("/")
+	s.PreRouteHook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-API-Version") == "" {
+			http.Error(w, "missing X-API-Version", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		called = true
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/thing", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.False(t, called)
+
+	req := newTestRequest("GET", "/thing", nil, "application/json")
+	req.Header.Set("X-API-Version", "2")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.True(t, called)
+}
+
+func TestMaxBody(t *testing.T) {
+	s := NewService("/")
+	s.MaxBodyBytes = 16
+	handler := func(cx *Context, req *Req) {
+		cx.RespondWithData(req.Message)
+	}
+	s.Post().Path("small").DecodeRequest(&Req{}).ToFunction(handler)
+	s.Post().Path("upload").DecodeRequest(&Req{}).MaxBody(1024).ToFunction(handler)
+	s.Post().Path("unlimited").DecodeRequest(&Req{}).MaxBody(-1).ToFunction(handler)
+	body := `{"Message": "` + strings.Repeat("x", 64) + `"}`
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/small", http.StatusRequestEntityTooLarge},
+		{"/upload", http.StatusOK},
+		{"/unlimited", http.StatusOK},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("POST", test.path, strings.NewReader(body), "application/json"))
+		assert.Equal(t, writer.Code, test.status, test.path)
+	}
+}
+
+func TestMaxBodyBinaryFormats(t *testing.T) {
+	s := NewService("/")
+	s.MaxBodyBytes = 64
+	s.Post().Path("upload").DecodeRequest(&Req{}).ToFunction(func(cx *Context, req *Req) {})
+	for _, ct := range []string{"application/bson", "application/x-msgpack"} {
+		body := &bytes.Buffer{}
+		assert.NoError(t, Serializers.Encode(ct, body, &Req{Message: strings.Repeat("x", 128)}))
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("POST", "/upload", body, ct))
+		assert.Equal(t, writer.Code, http.StatusRequestEntityTooLarge, ct)
+	}
+
+	// A BSON length prefix beyond the document limit is rejected without
+	// allocating it, even when the body is unlimited.
+	s.MaxBodyBytes = 0
+	body := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f, 0x00})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/upload", body, "application/bson"))
+	assert.Equal(t, writer.Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestContextNegotiate(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("page").ToFunction(func(cx *Context) {
+		cx.Negotiate(map[string]func() error{
+			"text/html": func() error {
+				cx.ResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, err := io.WriteString(cx.ResponseWriter, "<p>hello</p>")
+				return err
+			},
+			"application/json": func() error {
+				return cx.RespondWithData("hello")
+			},
+		})
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/page", nil, "text/html"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Equal(t, writer.Body.String(), "<p>hello</p>")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/page", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Values("Vary"), []string{"Accept"})
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, "hello")
+
+	req := newTestRequest("GET", "/page", nil, "")
+	req.Header.Set("Accept", "text/*;q=0.5, application/json")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/page", nil, "application/bson"))
+	assert.Equal(t, writer.Code, http.StatusNotAcceptable)
+}
+
+type testContextKey string
+
+func TestBaseContext(t *testing.T) {
+	s := NewService("/")
+	s.BaseContext = context.WithValue(context.Background(), testContextKey("db"), "handle")
+	var db, user interface{}
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		db = cx.Context().Value(testContextKey("db"))
+		user = cx.Context().Value(testContextKey("user"))
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	req := newTestRequest("GET", "/thing", nil, "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), testContextKey("user"), "bob"))
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, db, "handle")
+	assert.Equal(t, user, "bob")
+}
+
+func TestMaxRouteParams(t *testing.T) {
+	path := func(n int) string {
+		segments := make([]string, n)
+		for i := range segments {
+			segments[i] = fmt.Sprintf("{p%d}", i)
+		}
+		return strings.Join(segments, "/")
+	}
+	route := NewRoute().Path(path(MaxRouteParams))
+	assert.Equal(t, len(route.params), MaxRouteParams)
+	assert.Panics(t, func() { NewRoute().Path(path(MaxRouteParams + 1)) })
+}
+
+type testUser struct {
+	Name string
+}
+
+func TestValue(t *testing.T) {
+	var user *testUser
+	var found, wrongType bool
+	s := NewService("/")
+	s.Get().Path("me").BeforeDispatch(func(cx *Context, req interface{}) error {
+		cx.SetValue(testContextKey("user"), &testUser{Name: "alice"})
+		return nil
+	}).ToFunction(func(cx *Context) {
+		user, found = Value[*testUser](cx, testContextKey("user"))
+		_, wrongType = Value[string](cx, testContextKey("user"))
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", "/me", nil, "application/json"))
+	assert.True(t, found)
+	assert.Equal(t, user, &testUser{Name: "alice"})
+	assert.False(t, wrongType)
+}
+
+func TestServiceIndent(t *testing.T) {
+	for _, test := range []struct {
+		indent   string
+		expected string
+	}{
+		{"", `{"S":200,"E":null,"D":{"Seen":true,"Message":"hi"}}` + "\n"},
+		{"  ", "{\n  \"S\": 200,\n  \"E\": null,\n  \"D\": {\n    \"Seen\": true,\n    \"Message\": \"hi\"\n  }\n}\n"},
+	} {
+		s := NewService("/")
+		s.Indent = test.indent
+		s.Get().Path("thing").ToFunction(func(cx *Context) {
+			cx.RespondWithData(&Req{Seen: true, Message: "hi"})
+		})
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", "/thing", nil, "application/json"))
+		assert.Equal(t, writer.Body.String(), test.expected)
+	}
+}
+
+type customJSONSerializer struct {
+	JsonSerializer
+}
+
+func TestServiceSerializerOptions(t *testing.T) {
+	s := NewService("/")
+	s.Indent = "  "
+	first := s.serializers()
+	assert.Equal(t, reflect.ValueOf(s.serializers()).Pointer(), reflect.ValueOf(first).Pointer())
+	assert.Equal(t, first["application/json"].(*JsonSerializer).Indent, "  ")
+	s.DisallowUnknownFields = true
+	second := s.serializers()
+	assert.NotEqual(t, reflect.ValueOf(second).Pointer(), reflect.ValueOf(first).Pointer())
+	assert.True(t, second["application/json"].(*JsonSerializer).DisallowUnknownFields)
+
+	// A custom JSON serializer is not replaced.
+	custom := &customJSONSerializer{}
+	registered := Serializers["application/json"]
+	Serializers["application/json"] = custom
+	defer func() { Serializers["application/json"] = registered }()
+	assert.Equal(t, s.serializers()["application/json"], Serializer(custom))
+}
+
+func TestOptionalCatchAll(t *testing.T) {
+	var rest []string
+	s := NewService("/")
+	route := s.Get().Path("files/{rest...?}").ToFunction(func(cx *Context, r string) {
+		rest = append(rest, r)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	for _, path := range []string{"/files/", "/files/a/b"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK, path)
+	}
+	assert.Equal(t, rest, []string{"", "a/b"})
+	assert.Equal(t, route.Reverse(Args{}), "/files/")
+	assert.Equal(t, route.Reverse(Args{"rest": "a/b"}), "/files/a/b")
+
+	var parts []string
+	s.Get().Path("dirs/{path...?}").ToFunction(func(cx *Context, p ...string) {
+		parts = p
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", "/dirs/", nil, "application/json"))
+	assert.Equal(t, len(parts), 0)
+}
+
+func TestErrorContentType(t *testing.T) {
+	s := NewService("/")
+	s.ErrorContentType = "application/json"
+	s.Get().Path("things/{id}").ToFunction(func(cx *Context, id int) {
+		if id == 0 {
+			cx.RespondWithErrorMessage("no such thing", http.StatusNotFound)
+			return
+		}
+		cx.RespondWithData(&Req{Message: "thing"})
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/things/0", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/json; charset=utf-8")
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).E, "no such thing")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/things/1", nil, "application/x-msgpack"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "application/x-msgpack")
+}
+
+func TestOnError(t *testing.T) {
+	statuses := []int{}
+	s := NewService("/")
+	s.Logger = log.New(&bytes.Buffer{}, "", 0)
+	s.OnError = func(cx *Context, status int) {
+		statuses = append(statuses, status)
+	}
+	s.Get().Path("ok").ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.Get().Path("missing").ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusNotFound)
+	})
+	s.Get().Path("panic").ToFunction(func(cx *Context) {
+		panic("boom")
+	})
+	for _, path := range []string{"/ok", "/missing", "/panic", "/nowhere"} {
+		s.ServeHTTP(httptest.NewRecorder(), newTestRequest("GET", path, nil, "application/json"))
+	}
+	assert.Equal(t, statuses, []int{http.StatusNotFound, http.StatusInternalServerError, http.StatusNotFound})
+}
+
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	f.writes++
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestWriteErrorHandler(t *testing.T) {
+	writeErrors := []error{}
+	s := NewService("/")
+	s.WriteErrorHandler = func(cx *Context, err error) {
+		writeErrors = append(writeErrors, err)
+	}
+	s.Get().Path("thing").ToFunction(func(cx *Context) {
+		assert.Error(t, cx.RespondWithData("hello"))
+		_, err := cx.ResponseWriter.Write([]byte("more"))
+		assert.Error(t, err)
+	})
+	writer := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	assert.NotPanics(t, func() {
+		s.ServeHTTP(writer, newTestRequest("GET", "/thing", nil, "application/json"))
+	})
+	assert.Equal(t, writer.writes, 1)
+	assert.Equal(t, len(writeErrors), 1)
+	assert.Equal(t, writeErrors[0].Error(), "connection reset by peer")
+}
+
+func TestPassThrough(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("users/{name}").ToFunction(func(cx *Context, name string) {
+		if name != "admin" {
+			cx.PassThrough()
+			return
+		}
+		cx.RespondWithData("admin")
+	})
+	s.Get().Path("users/{name}").ToFunction(func(cx *Context, name string) {
+		cx.RespondWithData("user " + name)
+	})
+	s.Get().Path("responded").ToFunction(func(cx *Context) {
+		cx.RespondWithData("first")
+		assert.Equal(t, cx.PassThrough(), AlreadyResponded)
+	})
+
+	for path, expected := range map[string]string{
+		"/users/admin": "admin",
+		"/users/bob":   "user bob",
+		"/responded":   "first",
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, writer.Code, http.StatusOK, path)
+		assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, expected, path)
+	}
+}
+
+func TestExtensionNegotiation(t *testing.T) {
+	s := NewService("/")
+	s.ExtensionNegotiation = true
+	s.Get().Path("users/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData(id)
+	})
+	for _, test := range []struct {
+		path string
+		ct   string
+	}{
+		{"/users/5.json", "application/json"},
+		{"/users/5.msgpack", "application/x-msgpack"},
+		{"/users/5", "application/bson"},
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", test.path, nil, "application/bson"))
+		assert.Equal(t, writer.Code, http.StatusOK, test.path)
+		assert.Equal(t, writer.Header().Get("Content-Type"), withCharset(test.ct), test.path)
+		resp := &Response{}
+		assert.NoError(t, Serializers.Decode(test.ct, writer.Body, resp))
+		assert.EqualValues(t, resp.S, http.StatusOK)
+	}
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/5.json?x=1", nil, "application/bson"))
+	resp := decodeTestResponse(t, "application/json", writer, nil)
+	assert.EqualValues(t, resp.D, 5)
+}
+
+func TestDottedParams(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("files/{filename}").ToFunction(func(cx *Context, filename string) {
+		cx.RespondWithData(filename)
+	})
+	for _, filename := range []string{"report.2023.pdf", "archive.tar.gz", "data.json", ".profile"} {
+		assert.Equal(t, serveTestData(s, "GET", "/files/"+filename), filename)
+	}
+
+	// Only known format extensions are stripped, and only when enabled.
+	s.ExtensionNegotiation = true
+	assert.Equal(t, serveTestData(s, "GET", "/files/report.2023.pdf"), "report.2023.pdf")
+	assert.Equal(t, serveTestData(s, "GET", "/files/data.json"), "data")
+
+	// Routes can opt out of stripping.
+	s.Get().Path("kept/{filename}").KeepExtension().ToFunction(func(cx *Context, filename string) {
+		cx.RespondWithData(filename)
+	})
+	assert.Equal(t, serveTestData(s, "GET", "/kept/data.json"), "data.json")
+}
+
+func TestStripExtensionKeepsEscaping(t *testing.T) {
+	req := httptest.NewRequest("GET", "/files/a%2Fb.json?x=1", nil)
+	stripped := stripExtension(req)
+	assert.Equal(t, stripped.URL.EscapedPath(), "/files/a%2Fb")
+	assert.Equal(t, stripped.URL.Path, "/files/a/b")
+	assert.Equal(t, stripped.RequestURI, "/files/a%2Fb?x=1")
+	assert.Equal(t, req.URL.EscapedPath(), "/files/a%2Fb.json")
+}
+
+func TestRouteSetHeader(t *testing.T) {
+	s := NewService("/")
+	s.Post().Path("login").
+		SetHeader("Cache-Control", "no-store").
+		SetHeader("X-Frame-Options", "DENY").
+		ToFunction(func(cx *Context) {
+			cx.RespondWithStatus(http.StatusOK)
+		})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/login", strings.NewReader("{}"), "application/json"))
+	assert.Equal(t, writer.Header().Get("Cache-Control"), "no-store")
+	assert.Equal(t, writer.Header().Get("X-Frame-Options"), "DENY")
+}
+
+type testID string
+
+func TestCoerceKinds(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		v        interface{}
+		expected interface{}
+		err      bool
+	}{
+		{"-42", int(0), int(-42), false},
+		{"9223372036854775807", int64(0), int64(9223372036854775807), false},
+		{"9223372036854775808", int64(0), nil, true},
+		{"-128", int8(0), int8(-128), false},
+		{"-32768", int16(0), int16(-32768), false},
+		{"2147483647", int32(0), int32(2147483647), false},
+		{"2147483648", int32(0), nil, true},
+		{"42", uint(0), uint(42), false},
+		{"255", uint8(0), uint8(255), false},
+		{"256", uint8(0), nil, true},
+		{"65535", uint16(0), uint16(65535), false},
+		{"4294967295", uint32(0), uint32(4294967295), false},
+		{"4294967296", uint32(0), nil, true},
+		{"18446744073709551615", uint64(0), uint64(18446744073709551615), false},
+		{"-1", uint64(0), nil, true},
+		{"1.5", float32(0), float32(1.5), false},
+		{"1e39", float32(0), nil, true},
+		{"-2.25", float64(0), float64(-2.25), false},
+		{"x", float64(0), nil, true},
+		{"hello", "", "hello", false},
+		{"abc", testID(""), testID("abc"), false},
+		{"12", int(0), int(12), false},
+		{"twelve", int(0), nil, true},
+		{"true", false, nil, true},
+		{"1", []int{}, nil, true},
+	} {
+		v, err := coerce(test.s, reflect.TypeOf(test.v))
+		if test.err {
+			assert.Error(t, err, "%q as %T", test.s, test.v)
+			continue
+		}
+		assert.NoError(t, err, "%q as %T", test.s, test.v)
+		assert.Equal(t, v.Interface(), test.expected, "%q as %T", test.s, test.v)
+	}
+}
+
+func TestNamedTypeArgs(t *testing.T) {
+	type testCount int
+	s := NewService("/")
+	s.Get().Path("things/{id}/{count}").ToFunction(func(cx *Context, id testID, count testCount) {
+		cx.RespondWithData(fmt.Sprintf("%s %d", id, count))
+	})
+	assert.Equal(t, serveTestData(s, "GET", "/things/abc/3"), "abc 3")
+}
+
+func TestCoerceUnsupportedType(t *testing.T) {
+	_, err := coerce("1", reflect.TypeOf(struct{}{}))
+	assert.Equal(t, err.Error(), "unsupported argument type struct {}")
+}
+
+func TestAbort(t *testing.T) {
+	calls := []string{}
+	auth := func(cx *Context, next func() bool) bool {
+		calls = append(calls, "auth")
+		if cx.Request.Header.Get("Authorization") == "" {
+			cx.RespondWithStatus(http.StatusUnauthorized)
+			cx.Abort()
+		}
+		return next()
+	}
+	logging := func(cx *Context, next func() bool) bool {
+		calls = append(calls, "logging")
+		return next()
+	}
+	s := NewService("/")
+	s.Get().Path("secret").Use(auth, logging).ToFunction(func(cx *Context) {
+		calls = append(calls, "handler")
+		cx.RespondWithStatus(http.StatusOK)
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/secret", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusUnauthorized)
+	assert.Equal(t, calls, []string{"auth"})
+
+	calls = nil
+	req := newTestRequest("GET", "/secret", nil, "application/json")
+	req.Header.Set("Authorization", "Bearer token")
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, req)
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, calls, []string{"auth", "logging", "handler"})
+}
+
+func TestStrictSlashRedirect(t *testing.T) {
+	s := NewService("/")
+	s.StrictSlash = true
+	s.Post().Get().Path("x/").ToFunction(func(cx *Context) {
+		cx.RespondWithData(cx.Request.Method)
+	})
+	s.Get().Path("y").ToFunction(func(cx *Context) {})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/x", strings.NewReader("{}"), "application/json"))
+	assert.Equal(t, writer.Code, http.StatusPermanentRedirect)
+	assert.Equal(t, writer.Header().Get("Location"), "/x/")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/x?a=1", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusMovedPermanently)
+	assert.Equal(t, writer.Header().Get("Location"), "/x/?a=1")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/y/", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusMovedPermanently)
+	assert.Equal(t, writer.Header().Get("Location"), "/y")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("POST", "/y/", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+}
+
+func TestRoutePatternAndMatchGroups(t *testing.T) {
+	s := NewService("/api")
+	route := s.Get().Path("users/{id}/{rest...}").ToFunction(func(cx *Context, id int, rest string) {})
+	for _, path := range []string{"/api/users/5/a/b", "/api/users/5", "/api/things/5/a"} {
+		req := newTestRequest("GET", path, nil, "")
+		groups := route.MatchGroups(req)
+		assert.Equal(t, groups, route.match(req), path)
+		assert.Equal(t, route.Pattern().FindStringSubmatch(path), groups, path)
+	}
+	assert.Equal(t, route.MatchGroups(newTestRequest("GET", "/api/users/5/a/b", nil, "")), []string{"/api/users/5/a/b", "5", "a/b"})
+	assert.Nil(t, route.MatchGroups(newTestRequest("POST", "/api/users/5/a/b", nil, "")))
+}
+
+func TestServiceWhen(t *testing.T) {
+	s := NewService("/")
+	s.When(true).Get().Path("enabled").ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	s.When(false).Get().Path("disabled").Named("disabled").ToFunction(func(cx *Context) {
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	for path, status := range map[string]int{"/enabled": http.StatusOK, "/disabled": http.StatusNotFound} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, writer.Code, status, path)
+	}
+	assert.Nil(t, s.Find("disabled"))
+}
+
+func TestArgsHook(t *testing.T) {
+	var got string
+	s := NewService("/")
+	s.Get().Path("users/{id}").ArgsHook(func(args []string) ([]string, error) {
+		if strings.HasPrefix(args[0], "admin") {
+			return nil, errors.New("reserved user id")
+		}
+		return []string{strings.ToLower(args[0])}, nil
+	}).ToFunction(func(cx *Context, id string) {
+		got = id
+		cx.RespondWithStatus(http.StatusOK)
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/Bob", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusOK)
+	assert.Equal(t, got, "bob")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/users/admin1", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusBadRequest)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).E, "reserved user id")
+}
+
+func TestContextWriter(t *testing.T) {
+	var respondErr, writeErr error
+	s := NewService("/")
+	s.Get().Path("raw").ToFunction(func(cx *Context) {
+		cx.ResponseWriter.Header().Set("Content-Type", "text/csv")
+		cx.WriteStatus(http.StatusCreated)
+		var w io.Writer = cx
+		fmt.Fprintf(w, "a,b\n")
+		fmt.Fprintf(w, "1,2\n")
+		respondErr = cx.RespondWithData("ignored")
+	})
+	s.Get().Path("enveloped").ToFunction(func(cx *Context) {
+		cx.RespondWithData("first")
+		_, writeErr = cx.Write([]byte("second"))
+	})
+
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/raw", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusCreated)
+	assert.Equal(t, writer.Body.String(), "a,b\n1,2\n")
+	assert.Equal(t, respondErr, AlreadyResponded)
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/enveloped", nil, "application/json"))
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, "first")
+	assert.Equal(t, writeErr, AlreadyResponded)
+}
+
+func TestRouteQuery(t *testing.T) {
+	s := NewService("/")
+	s.Get().Path("posts/{id}").Query("action", "edit").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData("edit")
+	})
+	s.Get().Path("posts/{id}").Query("preview", "").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData("preview")
+	})
+	s.Get().Path("posts/{id}").ToFunction(func(cx *Context, id int) {
+		cx.RespondWithData("view")
+	})
+	for path, expected := range map[string]string{
+		"/posts/1?action=edit": "edit",
+		"/posts/1?action=view": "view",
+		"/posts/1?preview":     "preview",
+		"/posts/1":             "view",
+	} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).D, expected, path)
+	}
+	route, _, ok := s.Match("GET", "/posts/1?action=edit")
+	assert.True(t, ok)
+	assert.Equal(t, route, s.routes[0])
+	route, _, _ = s.Match("GET", "/posts/1")
+	assert.Equal(t, route, s.routes[2])
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(b)
+}
+
+type customIDs []int
+
+func (c customIDs) MarshalJSON() ([]byte, error) { return []byte(`"custom"`), nil }
+
+type textIDs []int
+
+func (c textIDs) MarshalText() ([]byte, error) { return []byte("text"), nil }
+
+func TestJsonStreamEnvelope(t *testing.T) {
+	data := make([]*Req, 1000)
+	for i := range data {
+		data[i] = &Req{Seen: i%2 == 0, Message: fmt.Sprintf("<item %d>", i)}
+	}
+	for _, response := range []*Response{
+		{S: 200, D: data},
+		{S: 422, E: "invalid", D: []int{}, Fields: []FieldError{{"a", "bad"}}, ErrorID: "abc"},
+		{S: 200, D: "not a slice"},
+		{S: 200, D: []byte("bytes")},
+		{S: 200, D: customIDs{1, 2}},
+		{S: 200, D: textIDs{1, 2}},
+	} {
+		expected := &bytes.Buffer{}
+		assert.NoError(t, (&JsonSerializer{}).NewEncoder(expected).Encode(response))
+		streamed := &countingWriter{}
+		assert.NoError(t, (&JsonSerializer{StreamEnvelope: true}).NewEncoder(streamed).Encode(response))
+		assert.Equal(t, streamed.String(), expected.String())
+		if _, ok := response.D.([]*Req); ok {
+			assert.True(t, streamed.writes > len(data))
+		}
+	}
+
+	s := NewService("/")
+	s.StreamJSON = true
+	s.Get().Path("items").ToFunction(func(cx *Context) {
+		cx.RespondWithData(data)
+	})
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/items", nil, "application/json"))
+	decoded := []*Req{}
+	decodeTestResponse(t, "application/json", writer, &decoded)
+	assert.Equal(t, decoded, data)
+}
+
+var errTestConflict = errors.New("version conflict")
+
+func TestRouteOnPanic(t *testing.T) {
+	s := NewService("/")
+	s.Logger = log.New(&bytes.Buffer{}, "", 0)
+	s.Put().Path("things/{id}").OnPanic(func(cx *Context, recovered interface{}) {
+		if recovered == errTestConflict {
+			cx.RespondWithErrorMessage("conflict", http.StatusConflict)
+			return
+		}
+		cx.InternalError(fmt.Errorf("panic: %v", recovered))
+	}).ToFunction(func(cx *Context, id int) {
+		if id == 1 {
+			panic(errTestConflict)
+		}
+		panic("unexpected")
+	})
+	for path, status := range map[string]int{"/things/1": http.StatusConflict, "/things/2": http.StatusInternalServerError} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("PUT", path, strings.NewReader("{}"), "application/json"))
+		assert.Equal(t, writer.Code, status, path)
+	}
+}
+
+func TestChooseSerializer(t *testing.T) {
+	for _, test := range []struct {
+		accept, contentType, def string
+		expected                 string
+	}{
+		{"", "", "", ""},
+		{"", "", "application/bson", "application/bson"},
+		{"", "application/x-msgpack", "application/bson", "application/x-msgpack"},
+		{"", "application/json; charset=utf-8", "", "application/json"},
+		{"", "application/x-www-form-urlencoded", "", ""},
+		{"", "application/x-www-form-urlencoded", "application/json", "application/json"},
+		{"*/*", "", "", "application/json"},
+		{"*/*", "", "application/bson", "application/bson"},
+		{"*/*", "text/plain", "", "application/json"},
+		{"application/*", "application/x-msgpack", "", "application/x-msgpack"},
+		{"application/bson", "application/json", "application/x-msgpack", "application/bson"},
+		{"application/bson;q=0.5, application/x-msgpack", "", "", "application/x-msgpack"},
+		{"application/bson, application/x-msgpack", "", "", "application/x-msgpack"},
+		{"application/foo, application/bson;q=0.1", "", "", "application/bson"},
+		{"application/json;q=0", "", "", ""},
+		{"text/html", "application/json", "application/json", ""},
+		{"application/x-www-form-urlencoded", "", "", ""},
+		{"garbage;;", "", "application/json", ""},
+	} {
+		ser, ct, ok := Serializers.chooseSerializer(test.accept, test.contentType, test.def)
+		assert.Equal(t, ct, test.expected, "%q %q %q", test.accept, test.contentType, test.def)
+		assert.Equal(t, ok, test.expected != "")
+		if ok {
+			expected := Serializers[test.expected]
+			assert.Equal(t, ser, expected)
+		}
+	}
+}
+
+func TestCoerceTrimsNumbers(t *testing.T) {
+	v, err := coerce(" 42 ", reflect.TypeOf(0))
+	assert.NoError(t, err)
+	assert.Equal(t, v.Interface(), 42)
+	v, err = coerce("\t1.5\n", reflect.TypeOf(float64(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, v.Interface(), 1.5)
+	v, err = coerce(" padded ", reflect.TypeOf(""))
+	assert.NoError(t, err)
+	assert.Equal(t, v.Interface(), " padded ")
+}
+
+func TestContextStatus(t *testing.T) {
+	statuses := map[string]int{}
+	metrics := func(cx *Context, next func() bool) bool {
+		handled := next()
+		statuses[cx.Request.URL.Path] = cx.Status()
+		return handled
+	}
+	s := NewService("/")
+	s.Get().Path("teapot").Use(metrics).ToHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	s.Get().Path("created").Use(metrics).ToFunction(func(cx *Context) {
+		cx.SetStatus(http.StatusCreated)
+		cx.RespondWithData("ok")
+	})
+	s.Get().Path("pending").Use(metrics).ToFunction(func(cx *Context) {
+		cx.SetStatus(http.StatusAccepted)
+	})
+	s.Get().Path("failed").Use(metrics).ToFunction(func(cx *Context) {
+		cx.SetStatus(http.StatusInternalServerError)
+	})
+	reported := []int{}
+	s.OnError = func(cx *Context, status int) { reported = append(reported, status) }
+	sent := map[string]int{}
+	for _, path := range []string{"/teapot", "/created", "/pending", "/failed"} {
+		writer := httptest.NewRecorder()
+		s.ServeHTTP(writer, newTestRequest("GET", path, nil, "application/json"))
+		sent[path] = writer.Code
+	}
+	expected := map[string]int{
+		"/teapot":  http.StatusTeapot,
+		"/created": http.StatusCreated,
+		"/pending": http.StatusAccepted,
+		"/failed":  http.StatusInternalServerError,
+	}
+	assert.Equal(t, statuses, expected)
+	// Recorded statuses are sent even if the handler writes nothing.
+	assert.Equal(t, sent, expected)
+	assert.Equal(t, reported, []int{http.StatusTeapot, http.StatusInternalServerError})
+}
+
+func TestBindJSON(t *testing.T) {
+	var bindErr error
+	received := &Req{}
+	s := NewService("/")
+	s.Post().Path("hook").ToFunction(func(cx *Context) {
+		bindErr = cx.BindJSON(received)
+		cx.RespondWithStatus(http.StatusOK)
+	})
+	req := newTestRequest("POST", "/hook", strings.NewReader(`{"Seen": true, "Message": "hi"}`), "text/plain")
+	req.Header.Set("Accept", "application/json")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, bindErr)
+	assert.Equal(t, received, &Req{Seen: true, Message: "hi"})
+
+	s.MaxBodyBytes = 8
+	req = newTestRequest("POST", "/hook", strings.NewReader(`{"Seen": true, "Message": "hi"}`), "text/plain")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, decodeErrorStatus(bindErr), http.StatusRequestEntityTooLarge)
+}
+
+func TestFindByPrefix(t *testing.T) {
+	s := NewService("/api")
+	users := s.Get().Path("v1/users").ToFunction(func(cx *Context) {})
+	user := s.Get().Path("v1/users/{id}").ToFunction(func(cx *Context, id int) {})
+	s.Get().Path("v2/users").ToFunction(func(cx *Context) {})
+	s.Get().Path("v10/users").ToFunction(func(cx *Context) {})
+	assert.Equal(t, s.FindByPrefix("/api/v1/"), []*Route{users, user})
+	assert.Equal(t, len(s.FindByPrefix("/api/")), 4)
+	assert.Equal(t, s.FindByPrefix("/other"), []*Route{})
+}
+
+func TestNotFoundWithoutNegotiation(t *testing.T) {
+	s := NewService("/")
+	writer := httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/nowhere", nil, ""))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.Equal(t, writer.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, writer.Body.String(), "Not Found\n")
+
+	writer = httptest.NewRecorder()
+	s.ServeHTTP(writer, newTestRequest("GET", "/nowhere", nil, "application/json"))
+	assert.Equal(t, writer.Code, http.StatusNotFound)
+	assert.Equal(t, decodeTestResponse(t, "application/json", writer, nil).S, http.StatusNotFound)
+}